@@ -0,0 +1,371 @@
+package cloudflare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// cfBatch is the body of a request to, and the result of a response
+// from, the batch DNS records endpoint. Cloudflare executes the
+// operations in the order deletes, patches, puts, posts, and either
+// all of them succeed or none of them take effect.
+type cfBatch struct {
+	Deletes []cfDNSRecord `json:"deletes,omitempty"`
+	Patches []cfDNSRecord `json:"patches,omitempty"`
+	Puts    []cfDNSRecord `json:"puts,omitempty"`
+	Posts   []cfDNSRecord `json:"posts,omitempty"`
+
+	// the values of patched and replaced records before the batch,
+	// keyed by ID, in case the changes need to be rolled back
+	previous map[string]cfDNSRecord
+
+	// if set, finds the existing record, if any, that is identical to a
+	// post (which Cloudflare refuses to create), so that the existing
+	// record can be returned as if it had been created
+	existing func(context.Context, cfDNSRecord) (cfDNSRecord, bool, error)
+
+	// the IDs of the records in Posts that already existed (results only)
+	existed map[string]bool
+}
+
+// cfBatchDelete identifies a record to delete in a batch request. (The
+// full cfDNSRecord type can't be used because it always has some fields.)
+type cfBatchDelete struct {
+	ID string `json:"id"`
+}
+
+func (b cfBatch) len() int {
+	return len(b.Deletes) + len(b.Patches) + len(b.Puts) + len(b.Posts)
+}
+
+// chunks splits the batch into batches of at most size operations,
+// preserving the order in which the operations are executed.
+func (b cfBatch) chunks(size int) []cfBatch {
+	var chunks []cfBatch
+	cur := cfBatch{existing: b.existing}
+	add := func(list *[]cfDNSRecord, rec cfDNSRecord) {
+		*list = append(*list, rec)
+		if cur.len() == size {
+			chunks = append(chunks, cur)
+			cur = cfBatch{existing: b.existing}
+		}
+	}
+	for _, rec := range b.Deletes {
+		add(&cur.Deletes, rec)
+	}
+	for _, rec := range b.Patches {
+		add(&cur.Patches, rec)
+	}
+	for _, rec := range b.Puts {
+		add(&cur.Puts, rec)
+	}
+	for _, rec := range b.Posts {
+		add(&cur.Posts, rec)
+	}
+	if cur.len() > 0 {
+		chunks = append(chunks, cur)
+	}
+	return chunks
+}
+
+// maxBatchSize is the maximum number of operations Cloudflare accepts in
+// a single batch request (on all plans).
+const maxBatchSize = 200
+
+// applyBatch executes the operations in batch, using as few batch requests
+// as possible. If the batch endpoint is unavailable, it falls back to one
+// request per operation. It returns the records that resulted from the
+// patches, puts, and posts. Deleted records are returned only by ID.
+//
+// If no changes were made when an error occurs, the error is an
+// [libdns.AtomicErr]. Otherwise, if the provider is configured to roll back
+// and it succeeds in doing so, the error is also an [libdns.AtomicErr];
+// if not, applyBatch returns the changes that were made along with a
+// *PartialError, which the caller should fill in with the applied records.
+func (p *Provider) applyBatch(ctx context.Context, zoneID string, batch cfBatch) (cfBatch, error) {
+	results, err := p.applyChunks(ctx, zoneID, batch)
+	if err == nil {
+		return results, nil
+	}
+	if results.len() == 0 {
+		return cfBatch{}, libdns.AtomicErr(err)
+	}
+	if !p.Rollback {
+		return results, &PartialError{Err: err}
+	}
+	if rbErr := p.rollback(ctx, zoneID, batch, results); rbErr != nil {
+		return results, &PartialError{Err: err, RollbackErr: rbErr}
+	}
+	return cfBatch{}, libdns.AtomicErr(err)
+}
+
+// applyChunks executes the operations in batch, one chunk at a time. On
+// error, it returns the results of the operations that were completed.
+func (p *Provider) applyChunks(ctx context.Context, zoneID string, batch cfBatch) (cfBatch, error) {
+	var results cfBatch
+	for _, chunk := range batch.chunks(maxBatchSize) {
+		var result cfBatch
+		var err error
+		if atomic.LoadInt32(&p.batchUnsupported) == 0 {
+			result, err = p.postBatch(ctx, zoneID, chunk)
+			if batchUnavailable(err) {
+				atomic.StoreInt32(&p.batchUnsupported, 1)
+			} else if chunk.existing != nil && errors.Is(err, ErrRecordExists) {
+				result, err = p.postBatchWithoutExisting(ctx, zoneID, chunk, err)
+			}
+		}
+		if atomic.LoadInt32(&p.batchUnsupported) == 1 {
+			result, err = p.applyEach(ctx, zoneID, chunk)
+		}
+		results.Deletes = append(results.Deletes, result.Deletes...)
+		results.Patches = append(results.Patches, result.Patches...)
+		results.Puts = append(results.Puts, result.Puts...)
+		results.Posts = append(results.Posts, result.Posts...)
+		for id := range result.existed {
+			if results.existed == nil {
+				results.existed = make(map[string]bool)
+			}
+			results.existed[id] = true
+		}
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// rollback undoes the changes in applied, which resulted from (part of)
+// batch: it deletes created records, restores updated records to their
+// previous values, and re-creates deleted records (which get new IDs).
+func (p *Provider) rollback(ctx context.Context, zoneID string, batch, applied cfBatch) error {
+	var undo cfBatch
+	for _, rec := range applied.Posts {
+		if applied.existed[rec.ID] {
+			continue // not created by us
+		}
+		undo.Deletes = append(undo.Deletes, cfDNSRecord{ID: rec.ID})
+	}
+	for _, rec := range append(applied.Patches, applied.Puts...) {
+		prev, ok := batch.previous[rec.ID]
+		if !ok {
+			return fmt.Errorf("previous value of record %s is unknown", rec.ID)
+		}
+		undo.Puts = append(undo.Puts, prev)
+	}
+	for _, rec := range applied.Deletes {
+		prev, ok := batch.deleted(rec.ID)
+		if !ok {
+			return fmt.Errorf("previous value of record %s is unknown", rec.ID)
+		}
+		prev.ID = ""
+		undo.Posts = append(undo.Posts, prev)
+	}
+
+	// don't let a cancelled context prevent cleaning up
+	ctx, cancel := context.WithTimeout(withoutCancel(ctx), rollbackTimeout)
+	defer cancel()
+
+	_, err := p.applyChunks(ctx, zoneID, undo)
+	return err
+}
+
+// rollbackTimeout bounds how long rolling back may take.
+const rollbackTimeout = 30 * time.Second
+
+// deleted returns the full record with the given ID from b.Deletes.
+func (b cfBatch) deleted(id string) (cfDNSRecord, bool) {
+	for _, rec := range b.Deletes {
+		if rec.ID == id {
+			return rec, true
+		}
+	}
+	return cfDNSRecord{}, false
+}
+
+// withoutCancel returns a context that carries ctx's values but is never
+// cancelled. (It is context.WithoutCancel, which requires Go 1.21.)
+func withoutCancel(ctx context.Context) context.Context {
+	return valueOnlyContext{ctx}
+}
+
+type valueOnlyContext struct{ context.Context }
+
+func (valueOnlyContext) Deadline() (deadline time.Time, ok bool) { return }
+func (valueOnlyContext) Done() <-chan struct{}                   { return nil }
+func (valueOnlyContext) Err() error                              { return nil }
+
+// postBatch sends a single batch request.
+func (p *Provider) postBatch(ctx context.Context, zoneID string, batch cfBatch) (cfBatch, error) {
+	body := struct {
+		Deletes []cfBatchDelete `json:"deletes,omitempty"`
+		Patches []cfDNSRecord   `json:"patches,omitempty"`
+		Puts    []cfDNSRecord   `json:"puts,omitempty"`
+		Posts   []cfDNSRecord   `json:"posts,omitempty"`
+	}{
+		Patches: batch.Patches,
+		Puts:    batch.Puts,
+		Posts:   batch.Posts,
+	}
+	for _, rec := range batch.Deletes {
+		body.Deletes = append(body.Deletes, cfBatchDelete{ID: rec.ID})
+	}
+	jsonBytes, err := json.Marshal(body)
+	if err != nil {
+		return cfBatch{}, err
+	}
+
+	reqURL := fmt.Sprintf("%s/zones/%s/dns_records/batch", p.baseURL(), zoneID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, bytes.NewReader(jsonBytes))
+	if err != nil {
+		return cfBatch{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var result cfBatch
+	_, err = p.doAPIRequest(req, &result)
+	return result, err
+}
+
+// postBatchWithoutExisting is for when a batch request failed with err
+// because some of the records to create already exist. (The batch fails
+// as a whole, without saying which ones.) It looks up the posts, and sends
+// the batch again without those that exist, so that it is still atomic.
+// The existing records are returned in their place.
+func (p *Provider) postBatchWithoutExisting(ctx context.Context, zoneID string, batch cfBatch, err error) (cfBatch, error) {
+	remaining := batch
+	remaining.Posts = nil
+	existing := make(map[int]cfDNSRecord)
+	for i, rec := range batch.Posts {
+		found, ok, findErr := batch.existing(ctx, rec)
+		if findErr != nil {
+			return cfBatch{}, findErr
+		}
+		if ok {
+			existing[i] = found
+		} else {
+			remaining.Posts = append(remaining.Posts, rec)
+		}
+	}
+	if len(existing) == 0 {
+		return cfBatch{}, err // the conflict is with a different record
+	}
+
+	var result cfBatch
+	if remaining.len() > 0 {
+		result, err = p.postBatch(ctx, zoneID, remaining)
+		if err != nil {
+			return cfBatch{}, err
+		}
+		if len(result.Posts) != len(remaining.Posts) {
+			return cfBatch{}, fmt.Errorf("batch created %d records instead of %d", len(result.Posts), len(remaining.Posts))
+		}
+	}
+
+	created := result.Posts
+	result.Posts = nil
+	result.existed = make(map[string]bool)
+	for i := range batch.Posts {
+		if rec, ok := existing[i]; ok {
+			result.Posts = append(result.Posts, rec)
+			result.existed[rec.ID] = true
+			continue
+		}
+		result.Posts = append(result.Posts, created[0])
+		created = created[1:]
+	}
+	return result, nil
+}
+
+// applyEach executes the operations in batch one request at a time,
+// for when the batch endpoint is not available. It is not atomic.
+func (p *Provider) applyEach(ctx context.Context, zoneID string, batch cfBatch) (cfBatch, error) {
+	var result cfBatch
+	for _, rec := range batch.Deletes {
+		if err := p.deleteRecord(ctx, zoneID, rec.ID); err != nil {
+			return result, err
+		}
+		result.Deletes = append(result.Deletes, cfDNSRecord{ID: rec.ID})
+	}
+	for _, rec := range batch.Patches {
+		updated, err := p.updateRecord(ctx, cfDNSRecord{ID: rec.ID, ZoneID: zoneID}, rec)
+		if err != nil {
+			return result, err
+		}
+		result.Patches = append(result.Patches, updated)
+	}
+	for _, rec := range batch.Puts {
+		replaced, err := p.replaceRecord(ctx, zoneID, rec)
+		if err != nil {
+			return result, err
+		}
+		result.Puts = append(result.Puts, replaced)
+	}
+	for _, rec := range batch.Posts {
+		created, err := p.postRecord(ctx, zoneID, rec)
+		if batch.existing != nil && errors.Is(err, ErrRecordExists) {
+			if existing, ok, findErr := batch.existing(ctx, rec); ok && findErr == nil {
+				created, err = existing, nil
+				if result.existed == nil {
+					result.existed = make(map[string]bool)
+				}
+				result.existed[created.ID] = true
+			}
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Posts = append(result.Posts, created)
+	}
+	return result, nil
+}
+
+// batchUnavailable returns true if err indicates that the batch endpoint
+// does not exist: the request failed with a status like 404 Not Found
+// because there is no route for it (as opposed to, say, a record in the
+// batch not existing, which is also a 404).
+func batchUnavailable(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.StatusCode {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return len(apiErr.Errors) == 0 || apiErr.HasCode(noRouteCode)
+	}
+	return false
+}
+
+// partialResult is for when applyBatch fails. If err is a *PartialError, it
+// fills in the records that were changed (as reported by applied, which
+// resulted from batch) and returns them with the error; otherwise it
+// returns just err.
+func partialResult(zone string, batch, applied cfBatch, err error) ([]libdns.Record, error) {
+	var partialErr *PartialError
+	if !errors.As(err, &partialErr) {
+		return nil, err
+	}
+	var changed []cfDNSRecord
+	for _, rec := range applied.Deletes {
+		if full, ok := batch.deleted(rec.ID); ok {
+			rec = full
+		}
+		changed = append(changed, rec)
+	}
+	changed = append(changed, applied.Patches...)
+	changed = append(changed, applied.Puts...)
+	changed = append(changed, applied.Posts...)
+	for _, cfRec := range changed {
+		if libdnsRec, err := cfRec.libdnsRecord(zone); err == nil {
+			partialErr.Applied = append(partialErr.Applied, libdnsRec)
+		}
+	}
+	return partialErr.Applied, partialErr
+}
@@ -5,9 +5,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/libdns/libdns"
 )
@@ -17,12 +20,17 @@ func (p *Provider) createRecord(ctx context.Context, zoneInfo cfZone, record lib
 	if err != nil {
 		return cfDNSRecord{}, err
 	}
+	return p.postRecord(ctx, zoneInfo.ID, cfRec)
+}
+
+// postRecord creates cfRec in the zone with the given ID.
+func (p *Provider) postRecord(ctx context.Context, zoneID string, cfRec cfDNSRecord) (cfDNSRecord, error) {
 	jsonBytes, err := json.Marshal(cfRec)
 	if err != nil {
 		return cfDNSRecord{}, err
 	}
 
-	reqURL := fmt.Sprintf("%s/zones/%s/dns_records", baseURL, zoneInfo.ID)
+	reqURL := fmt.Sprintf("%s/zones/%s/dns_records", p.baseURL(), zoneID)
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, bytes.NewReader(jsonBytes))
 	if err != nil {
 		return cfDNSRecord{}, err
@@ -41,7 +49,7 @@ func (p *Provider) createRecord(ctx context.Context, zoneInfo cfZone, record lib
 // updateRecord updates a DNS record. oldRec must have both an ID and zone ID.
 // Only the non-empty fields in newRec will be changed.
 func (p *Provider) updateRecord(ctx context.Context, oldRec, newRec cfDNSRecord) (cfDNSRecord, error) {
-	reqURL := fmt.Sprintf("%s/zones/%s/dns_records/%s", baseURL, oldRec.ZoneID, oldRec.ID)
+	reqURL := fmt.Sprintf("%s/zones/%s/dns_records/%s", p.baseURL(), oldRec.ZoneID, oldRec.ID)
 	jsonBytes, err := json.Marshal(newRec)
 	if err != nil {
 		return cfDNSRecord{}, err
@@ -59,75 +67,145 @@ func (p *Provider) updateRecord(ctx context.Context, oldRec, newRec cfDNSRecord)
 	return result, err
 }
 
-func (p *Provider) getDNSRecords(ctx context.Context, zoneInfo cfZone, rec libdns.Record, matchContent bool) ([]cfDNSRecord, error) {
-	rr, err := cloudflareRecord(rec)
+// replaceRecord replaces (overwrites) the record with rec.ID with rec.
+// Unlike updateRecord, fields that are empty in rec are reset.
+func (p *Provider) replaceRecord(ctx context.Context, zoneID string, rec cfDNSRecord) (cfDNSRecord, error) {
+	reqURL := fmt.Sprintf("%s/zones/%s/dns_records/%s", p.baseURL(), zoneID, rec.ID)
+	jsonBytes, err := json.Marshal(rec)
 	if err != nil {
-		return nil, err
+		return cfDNSRecord{}, err
 	}
 
-	qs := make(url.Values)
-	qs.Set("type", rr.Type)
-	qs.Set("name", libdns.AbsoluteName(rr.Name, zoneInfo.Name))
-
-	var unwrappedContent string
-	if matchContent {
-		if rr.Type == "TXT" {
-			unwrappedContent = unwrapContent(rr.Content)
-			// Use the contains (wildcard) search with unquoted content to return both quoted and unquoted content
-			qs.Set("content.contains", unwrappedContent)
-		} else if rr.Type != "SRV" && rr.Type != "HTTPS" && rr.Type != "SVCB" {
-			// SRV, HTTPS, SVCB records don't support content.exact filtering in Cloudflare API
-			// They will be matched by type and name only
-			qs.Set("content.exact", rr.Content)
-		}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, reqURL, bytes.NewReader(jsonBytes))
+	if err != nil {
+		return cfDNSRecord{}, err
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	reqURL := fmt.Sprintf("%s/zones/%s/dns_records?%s", baseURL, zoneInfo.ID, qs.Encode())
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	var result cfDNSRecord
+	_, err = p.doAPIRequest(req, &result)
+	return result, err
+}
+
+// deleteRecord deletes the record with the given ID.
+func (p *Provider) deleteRecord(ctx context.Context, zoneID, recordID string) error {
+	reqURL := fmt.Sprintf("%s/zones/%s/dns_records/%s", p.baseURL(), zoneID, recordID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, reqURL, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	_, err = p.doAPIRequest(req, nil)
+	return err
+}
 
-	var results []cfDNSRecord
-	_, err = p.doAPIRequest(req, &results)
+// getDNSRecords gets the records in the zone with the same name as rec and,
+// if rec has a type, the same type. If matchContent is true, only the records
+// that also match the rest of rec are returned, following the libdns rules
+// for deletion: empty data matches any data, and a zero TTL matches any TTL.
+func (p *Provider) getDNSRecords(ctx context.Context, zoneInfo cfZone, rec libdns.Record, matchContent bool) ([]cfDNSRecord, error) {
+	rr := rec.RR()
+	matchData := matchContent && rr.Data != ""
 
-	// Since the TXT search used contains (wildcard), check for exact matches
-	if matchContent && rr.Type == "TXT" {
-		for i := 0; i < len(results); i++ {
-			// Prefer exact quoted content
-			if results[i].Content == rr.Content {
-				return []cfDNSRecord{results[i]}, nil
-			}
+	qs := make(url.Values)
+	qs.Set("name", normalizeDomain(libdns.AbsoluteName(rr.Name, zoneInfo.Name)))
+	if rr.Type != "" {
+		qs.Set("type", rr.Type)
+	}
+	if matchData && rr.Type != "" {
+		// narrow down the results with a content filter where we can; the
+		// results are compared with rec below either way, so if rec can't
+		// be converted (e.g. an RR with unparsable data), we just skip it
+		if parsed, err := rr.Parse(); err == nil {
+			rec = parsed
 		}
-
-		for i := 0; i < len(results); i++ {
-			// Using exact unquoted content is acceptable
-			if results[i].Content == unwrappedContent {
-				return []cfDNSRecord{results[i]}, nil
+		if cfRec, err := cloudflareRecord(rec); err == nil {
+			switch rr.Type {
+			case "TXT":
+				// Use the contains (wildcard) search with unquoted content to return both quoted and unquoted content;
+				// text that is split into several strings, or that may be escaped, is matched by name only, since
+				// Cloudflare may split or escape it differently
+				if text := unwrapContent(cfRec.Content); len(text) <= maxTXTStringLen && !needsEscaping(text) {
+					qs.Set("content.contains", text)
+				}
+			case "CAA", "SRV", "HTTPS", "SVCB", "LOC", "SSHFP", "TLSA", "SMIMEA", "CERT", "DNSKEY", "DS", "NAPTR", "URI":
+				// Records with structured data don't support content.exact filtering in Cloudflare API (or,
+				// for CAA, the value may be escaped differently)
+				// They will be matched by type and name only
+			default:
+				qs.Set("content.exact", cfRec.Content)
 			}
 		}
+	}
 
-		return []cfDNSRecord{}, nil
+	const maxPageSize = 100
+	results, err := getAllPages[cfDNSRecord](ctx, p, "/zones/"+zoneInfo.ID+"/dns_records", qs, maxPageSize)
+	if err != nil || !matchContent {
+		return results, err
 	}
 
-	return results, err
+	matches := make([]cfDNSRecord, 0, len(results))
+	for _, result := range results {
+		if result.matches(zoneInfo.Name, rr) {
+			matches = append(matches, result)
+		}
+	}
+	return matches, nil
 }
 
-func (p *Provider) getZoneInfo(ctx context.Context, zoneName string) (cfZone, error) {
-	p.zonesMu.Lock()
-	defer p.zonesMu.Unlock()
+// matches returns true if r matches rr, apart from the name, following the
+// libdns rules for deletion: an empty type or data, or a zero TTL, matches
+// any value.
+func (r cfDNSRecord) matches(zone string, rr libdns.RR) bool {
+	if rr.Type != "" && !strings.EqualFold(r.Type, rr.Type) {
+		return false
+	}
+	// (proxied records all have the automatic TTL, so theirs doesn't matter)
+	if rr.TTL != 0 && !derefBool(r.Proxied) && r.TTL != cloudflareTTL(rr.TTL) {
+		return false
+	}
+	if rr.Data == "" {
+		return true
+	}
+	existing, err := r.libdnsRecord(zone)
+	if err != nil {
+		return false
+	}
+	// the type may be empty, in which case only the data is compared
+	exRR := existing.RR()
+	return sameData(exRR, libdns.RR{Type: exRR.Type, Data: rr.Data})
+}
 
-	// if we already got the zone info, reuse it
-	if p.zones == nil {
-		p.zones = make(map[string]cfZone)
+// findIdentical finds the existing record in the zone that is identical to
+// cfRec, regardless of TTL and Cloudflare-specific attributes. It returns
+// false if there is none.
+func (p *Provider) findIdentical(ctx context.Context, zoneInfo cfZone, cfRec cfDNSRecord) (cfDNSRecord, bool, error) {
+	rec, err := cfRec.libdnsRecord(zoneInfo.Name)
+	if err != nil {
+		return cfDNSRecord{}, false, err
 	}
-	if zone, ok := p.zones[zoneName]; ok {
-		return zone, nil
+	rr := rec.RR()
+	rr.TTL = 0
+	matches, err := p.getDNSRecords(ctx, zoneInfo, rr, true)
+	if err != nil || len(matches) == 0 {
+		return cfDNSRecord{}, false, err
 	}
+	return matches[0], true, nil
+}
+
+// getZoneInfo returns the info for the named zone, from the cache if possible.
+// The zone name may be in any form (see normalizeDomain).
+func (p *Provider) getZoneInfo(ctx context.Context, zoneName string) (cfZone, error) {
+	name := normalizeDomain(zoneName)
+	return p.zoneCache.get(ctx, name, p.zoneCacheTTL(), func(ctx context.Context) (cfZone, error) {
+		return p.fetchZoneInfo(ctx, name)
+	})
+}
 
+// fetchZoneInfo looks up the named zone with the API.
+func (p *Provider) fetchZoneInfo(ctx context.Context, zoneName string) (cfZone, error) {
 	qs := make(url.Values)
 	qs.Set("name", zoneName)
-	reqURL := fmt.Sprintf("%s/zones?%s", baseURL, qs.Encode())
+	reqURL := fmt.Sprintf("%s/zones?%s", p.baseURL(), qs.Encode())
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
 	if err != nil {
@@ -142,16 +220,118 @@ func (p *Provider) getZoneInfo(ctx context.Context, zoneName string) (cfZone, er
 	if err != nil {
 		return cfZone{}, err
 	}
+	if len(zones) == 0 {
+		return cfZone{}, fmt.Errorf("%w: %s", ErrZoneNotFound, zoneName)
+	}
 	if len(zones) != 1 {
 		return cfZone{}, fmt.Errorf("expected 1 zone, got %d for %s", len(zones), zoneName)
 	}
 
-	// cache this zone for possible reuse
-	p.zones[zoneName] = zones[0]
-
 	return zones[0], nil
 }
 
+// getAllPages gets every page of results from the list endpoint at path
+// (relative to the base URL) with the given query, requesting perPage
+// results per page. After the first page, which says how many pages there
+// are, the rest of the pages are fetched concurrently. Results are returned
+// in order.
+func getAllPages[T any](ctx context.Context, p *Provider, path string, query url.Values, perPage int) ([]T, error) {
+	first, lastPage, err := getPage[T](ctx, p, path, query, 1, perPage)
+	if err != nil {
+		return nil, err
+	}
+	if lastPage <= 1 {
+		return first, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pages := make([][]T, lastPage+1)
+	pages[1] = first
+	pageNums := make(chan int)
+	errs := make(chan error, lastPage)
+
+	var wg sync.WaitGroup
+	for i := 0; i < p.pageConcurrency() && i < lastPage-1; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for page := range pageNums {
+				results, _, err := getPage[T](ctx, p, path, query, page, perPage)
+				if err != nil {
+					errs <- fmt.Errorf("getting page %d: %w", page, err)
+					cancel()
+					return
+				}
+				pages[page] = results
+			}
+		}()
+	}
+feed:
+	for page := 2; page <= lastPage; page++ {
+		select {
+		case pageNums <- page:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(pageNums)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	all := first
+	for _, results := range pages[2:] {
+		all = append(all, results...)
+	}
+	return all, nil
+}
+
+// getPage gets a single page of results from a list endpoint; see
+// getAllPages. It also returns the number of the last page, if known.
+func getPage[T any](ctx context.Context, p *Provider, path string, query url.Values, page, perPage int) ([]T, int, error) {
+	qs := make(url.Values)
+	for k, v := range query {
+		qs[k] = v
+	}
+	qs.Set("page", strconv.Itoa(page))
+	qs.Set("per_page", strconv.Itoa(perPage))
+	reqURL := fmt.Sprintf("%s%s?%s", p.baseURL(), path, qs.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var results []T
+	response, err := p.doAPIRequest(req, &results)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if response.ResultInfo == nil || response.ResultInfo.PerPage <= 0 || len(results) == 0 {
+		return results, page, nil
+	}
+	lastPage := (response.ResultInfo.TotalCount + response.ResultInfo.PerPage - 1) / response.ResultInfo.PerPage
+	return results, lastPage, nil
+}
+
+// pageConcurrency returns how many pages of results may be fetched at once.
+func (p *Provider) pageConcurrency() int {
+	if p.PageConcurrency <= 0 {
+		return 4
+	}
+	return p.PageConcurrency
+}
+
 // getClient returns http client to use
 func (p *Provider) getClient() HTTPClient {
 	if p.HTTPClient == nil {
@@ -162,56 +342,128 @@ func (p *Provider) getClient() HTTPClient {
 
 // doAPIRequest does the round trip, adding Authorization header if not already supplied.
 // It returns the decoded response from Cloudflare if successful; otherwise it returns an
-// error including error information from the API if applicable. If result is a
+// *APIError including error information from the API if applicable. If result is a
 // non-nil pointer, the result field from the API response will be decoded into
-// it for convenience.
+// it for convenience; if it is a *[]byte, the raw body of a successful response
+// is put in it instead, for endpoints that don't respond with JSON.
+// Every attempt waits on the provider's rate limiter, if any, and requests
+// that fail with a transient error are retried according to the provider's
+// retry policy.
 func (p *Provider) doAPIRequest(req *http.Request, result any) (cfResponse, error) {
 	if req.Header.Get("Authorization") == "" {
 		req.Header.Set("Authorization", "Bearer "+p.APIToken)
 	}
 
+	limiter := p.rateLimiter(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+
+	policy := p.retryPolicy()
+	for attempt := 1; ; attempt++ {
+		if limiter != nil {
+			if err := limiter.Wait(req.Context()); err != nil {
+				return cfResponse{}, err
+			}
+		}
+
+		respData, resp, err := p.doAPIRequestOnce(req, result)
+		p.invalidateZoneOnError(req, err)
+		if err == nil || attempt >= policy.MaxAttempts || !policy.shouldRetry(req, resp, respData) {
+			return respData, err
+		}
+
+		wait, ok := policy.delay(attempt+1, resp)
+		if !ok {
+			return respData, err
+		}
+		if sleepContext(req.Context(), wait) != nil {
+			return respData, err // report the API error, not the context error
+		}
+
+		req, err = rewindRequest(req)
+		if err != nil {
+			return cfResponse{}, err
+		}
+	}
+}
+
+// doAPIRequestOnce makes a single attempt at the request. The returned
+// *http.Response, if not nil, has its body already read and closed; it is
+// only useful for its status and headers.
+func (p *Provider) doAPIRequestOnce(req *http.Request, result any) (cfResponse, *http.Response, error) {
 	resp, err := p.getClient().Do(req)
 	if err != nil {
-		return cfResponse{}, err
+		return cfResponse{}, nil, err
 	}
 	defer resp.Body.Close()
 
+	if raw, ok := result.(*[]byte); ok && resp.StatusCode < 400 {
+		*raw, err = io.ReadAll(resp.Body)
+		return cfResponse{}, resp, err
+	}
+
 	var respData cfResponse
 	err = json.NewDecoder(resp.Body).Decode(&respData)
 	if err != nil {
-		return cfResponse{}, err
+		if resp.StatusCode >= 400 {
+			// transient errors (502s and such) often come back as HTML from the edge
+			return cfResponse{}, resp, newAPIError(req, resp, nil)
+		}
+		return cfResponse{}, resp, err
 	}
 
-	if resp.StatusCode >= 400 {
-		return cfResponse{}, fmt.Errorf("got error status: HTTP %d: %+v", resp.StatusCode, respData.Errors)
-	}
-	if len(respData.Errors) > 0 {
-		return cfResponse{}, fmt.Errorf("got errors: HTTP %d: %+v", resp.StatusCode, respData.Errors)
+	if resp.StatusCode >= 400 || len(respData.Errors) > 0 {
+		return respData, resp, newAPIError(req, resp, respData.Errors)
 	}
 
 	if len(respData.Result) > 0 && result != nil {
 		err = json.Unmarshal(respData.Result, result)
 		if err != nil {
-			return cfResponse{}, err
+			return cfResponse{}, resp, err
 		}
 		respData.Result = nil
 	}
 
-	return respData, err
+	return respData, resp, nil
 }
 
-const baseURL = "https://api.cloudflare.com/client/v4"
+// baseURL returns the base URL of the API, without a trailing slash.
+func (p *Provider) baseURL() string {
+	if p.BaseURL == "" {
+		return defaultBaseURL
+	}
+	return strings.TrimSuffix(p.BaseURL, "/")
+}
+
+const defaultBaseURL = "https://api.cloudflare.com/client/v4"
 
+// unwrapContent returns the text of TXT record content, which Cloudflare
+// stores as one or more quoted character-strings in presentation format:
+// the strings are unquoted, unescaped, and joined. Content that isn't
+// quoted is returned as-is.
 func unwrapContent(content string) string {
-	if strings.HasPrefix(content, `"`) && strings.HasSuffix(content, `"`) {
-		content = strings.TrimPrefix(strings.TrimSuffix(content, `"`), `"`)
+	if !strings.HasPrefix(content, `"`) || !strings.HasSuffix(content, `"`) {
+		return content
 	}
-	return content
+	strs, err := rdataFields(content)
+	if err != nil {
+		return content
+	}
+	return strings.Join(strs, "")
 }
 
+// maxTXTStringLen is the maximum length of a character-string in
+// a TXT record; longer text has to be split into several of them.
+const maxTXTStringLen = 255
+
+// wrapContent returns text as TXT record content for Cloudflare: split
+// into quoted character-strings of up to 255 bytes (before escaping),
+// separated by spaces. (The text is never already quoted; quotes in it
+// are part of the text.)
 func wrapContent(content string) string {
-	if !strings.HasPrefix(content, `"`) && !strings.HasSuffix(content, `"`) {
-		content = fmt.Sprintf("%q", content)
+	var strs []string
+	for len(content) > maxTXTStringLen {
+		strs = append(strs, quoteField(content[:maxTXTStringLen]))
+		content = content[maxTXTStringLen:]
 	}
-	return content
+	strs = append(strs, quoteField(content))
+	return strings.Join(strs, " ")
 }
@@ -0,0 +1,654 @@
+package cloudflaretest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record is a DNS record as stored and returned by the fake server. Its
+// JSON form matches Cloudflare's.
+type Record struct {
+	ID         string         `json:"id"`
+	Type       string         `json:"type"`
+	Name       string         `json:"name"`
+	Content    string         `json:"content"`
+	Priority   *uint16        `json:"priority,omitempty"`
+	Proxiable  bool           `json:"proxiable"`
+	Proxied    bool           `json:"proxied"`
+	TTL        int            `json:"ttl"`
+	Locked     bool           `json:"locked"`
+	ZoneID     string         `json:"zone_id"`
+	ZoneName   string         `json:"zone_name"`
+	Comment    *string        `json:"comment"`
+	Tags       []string       `json:"tags"`
+	Settings   map[string]any `json:"settings"`
+	Data       map[string]any `json:"data,omitempty"`
+	Meta       map[string]any `json:"meta,omitempty"`
+	CreatedOn  time.Time      `json:"created_on"`
+	ModifiedOn time.Time      `json:"modified_on"`
+
+	// fields present in the request that created or updated this record;
+	// only used while decoding input
+	present map[string]json.RawMessage
+}
+
+// UnmarshalJSON decodes a record from a request body, remembering which
+// fields were present so that PATCH can leave the others alone.
+func (r *Record) UnmarshalJSON(b []byte) error {
+	type plain Record
+	var rec plain
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return err
+	}
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(b, &present); err != nil {
+		return err
+	}
+	*r = Record(rec)
+	r.present = present
+	return nil
+}
+
+type zone struct {
+	ID                  string    `json:"id"`
+	Name                string    `json:"name"`
+	Status              string    `json:"status"`
+	Paused              bool      `json:"paused"`
+	Type                string    `json:"type"`
+	DevelopmentMode     int       `json:"development_mode"`
+	NameServers         []string  `json:"name_servers"`
+	OriginalNameServers []string  `json:"original_name_servers"`
+	OriginalRegistrar   string    `json:"original_registrar"`
+	OriginalDnshost     string    `json:"original_dnshost"`
+	CreatedOn           time.Time `json:"created_on"`
+	ModifiedOn          time.Time `json:"modified_on"`
+	ActivatedOn         time.Time `json:"activated_on"`
+	Account             struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"account"`
+	Permissions []string `json:"permissions"`
+	Plan        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"plan"`
+
+	Records []Record `json:"-"`
+}
+
+func (z *zone) recordIndex(id string) int {
+	for i, rec := range z.Records {
+		if rec.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// absoluteName qualifies name within the zone the way Cloudflare does:
+// "@" is the apex, and names not already ending in the zone name are
+// relative to it.
+func (z *zone) absoluteName(name string) string {
+	name = normalizeName(name)
+	if name == "" || name == "@" {
+		return z.Name
+	}
+	if name == z.Name || strings.HasSuffix(name, "."+z.Name) {
+		return name
+	}
+	return name + "." + z.Name
+}
+
+// normalizeName returns name in the form Cloudflare uses: lowercase and
+// without a trailing dot.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func (s *Server) create(z *zone, input Record) (Record, *apiError) {
+	rec := Record{
+		ID:      s.newID(),
+		Type:    input.Type,
+		Name:    input.Name,
+		Content: input.Content,
+		TTL:     input.TTL,
+		Proxied: input.Proxied,
+		Comment: input.Comment,
+		Tags:    input.Tags,
+		Data:    input.Data,
+	}
+	if _, ok := input.present["priority"]; ok {
+		rec.Priority = input.Priority
+	}
+	if input.Settings != nil {
+		rec.Settings = input.Settings
+	}
+	rec.CreatedOn = time.Now().UTC()
+	rec.ModifiedOn = rec.CreatedOn
+
+	if apiErr := s.validate(z, &rec); apiErr != nil {
+		return Record{}, apiErr
+	}
+	z.Records = append(z.Records, rec)
+	return rec, nil
+}
+
+// update replaces (PUT) or modifies (PATCH) the record with input.ID.
+func (s *Server) update(z *zone, input Record, patch bool) (Record, *apiError) {
+	idx := z.recordIndex(input.ID)
+	if idx < 0 {
+		return Record{}, &errRecordNotFound
+	}
+	existing := z.Records[idx]
+	if existing.Locked || metaBool(existing.Meta, "read_only") {
+		return Record{}, &errRecordLocked
+	}
+
+	rec := existing
+	if !patch {
+		rec = Record{
+			ID:        existing.ID,
+			Type:      existing.Type,
+			CreatedOn: existing.CreatedOn,
+		}
+	}
+	for field := range input.present {
+		switch field {
+		case "type":
+			rec.Type = input.Type
+		case "name":
+			rec.Name = input.Name
+		case "content":
+			rec.Content = input.Content
+		case "priority":
+			rec.Priority = input.Priority
+		case "proxied":
+			rec.Proxied = input.Proxied
+		case "ttl":
+			rec.TTL = input.TTL
+		case "comment":
+			rec.Comment = input.Comment
+		case "tags":
+			rec.Tags = input.Tags
+		case "settings":
+			rec.Settings = input.Settings
+		case "data":
+			rec.Data = input.Data
+		}
+	}
+	if _, ok := input.present["data"]; ok && !patch {
+		rec.Content = ""
+	}
+	if _, ok := input.present["data"]; !ok && input.Content != "" {
+		// new content supersedes old structured data
+		rec.Data = nil
+	}
+	rec.ModifiedOn = time.Now().UTC()
+
+	if apiErr := s.validate(z, &rec); apiErr != nil {
+		return Record{}, apiErr
+	}
+	z.Records[idx] = rec
+	return rec, nil
+}
+
+func (s *Server) delete(z *zone, id string) *apiError {
+	idx := z.recordIndex(id)
+	if idx < 0 {
+		return &errRecordNotFound
+	}
+	if z.Records[idx].Locked || metaBool(z.Records[idx].Meta, "read_only") {
+		return &errRecordLocked
+	}
+	z.Records = append(z.Records[:idx], z.Records[idx+1:]...)
+	return nil
+}
+
+// validate normalizes rec in place and checks it for errors, including
+// conflicts with the other records in the zone.
+func (s *Server) validate(z *zone, rec *Record) *apiError {
+	rec.Type = strings.ToUpper(rec.Type)
+	rec.Name = z.absoluteName(rec.Name)
+	rec.ZoneID, rec.ZoneName = z.ID, z.Name
+	if rec.Tags == nil {
+		rec.Tags = []string{}
+	}
+	if rec.Settings == nil {
+		rec.Settings = map[string]any{}
+	}
+
+	if rec.Type == "" {
+		return &apiError{9000, "DNS record type is invalid."}
+	}
+
+	if rec.TTL == 0 {
+		rec.TTL = 1
+	}
+	if rec.TTL != 1 && (rec.TTL < 60 || rec.TTL > 86400) {
+		return &apiError{9021, "Invalid TTL. Must be between 60 and 86400 seconds, or 1 for Automatic."}
+	}
+
+	switch rec.Type {
+	case "A", "AAAA", "CNAME":
+		rec.Proxiable = true
+	default:
+		rec.Proxiable = false
+	}
+	if rec.Proxied {
+		if !rec.Proxiable {
+			return &apiError{9004, "This record type cannot be proxied."}
+		}
+		rec.TTL = 1
+	}
+
+	if len(rec.Data) > 0 {
+		content, apiErr := contentFromData(rec)
+		if apiErr != nil {
+			return apiErr
+		}
+		rec.Content = content
+	}
+
+	switch rec.Type {
+	case "A", "AAAA":
+		addr, err := netip.ParseAddr(rec.Content)
+		if err != nil || (rec.Type == "A") != addr.Is4() {
+			return &apiError{9005, fmt.Sprintf("Content for %s record is invalid.", rec.Type)}
+		}
+	case "CNAME", "MX", "NS":
+		rec.Content = strings.TrimSuffix(rec.Content, ".")
+	case "TXT":
+		for _, str := range txtStrings(rec.Content) {
+			if len(str) > 255 {
+				return &apiError{9100, "TXT content contains a character-string longer than 255 bytes."}
+			}
+		}
+	}
+	if rec.Type == "MX" && rec.Priority == nil {
+		var zero uint16
+		rec.Priority = &zero
+	}
+	if rec.Content == "" {
+		return &apiError{9005, fmt.Sprintf("Content for %s record is invalid.", rec.Type)}
+	}
+
+	for _, other := range z.Records {
+		if other.ID == rec.ID || other.Name != rec.Name {
+			continue
+		}
+		if other.Type == "CNAME" || rec.Type == "CNAME" {
+			return &errCNAMEConflict
+		}
+		if other.Type == rec.Type && other.Content == rec.Content && priorityOf(other) == priorityOf(*rec) {
+			return &errIdenticalRecord
+		}
+	}
+
+	return nil
+}
+
+// contentFromData builds the content of a record whose value is given
+// in structured data fields, like Cloudflare does.
+func contentFromData(rec *Record) (string, *apiError) {
+	d := rec.Data
+	invalid := &apiError{9101, fmt.Sprintf("Invalid data for %s record.", rec.Type)}
+	switch rec.Type {
+	case "SRV":
+		if !strings.HasPrefix(rec.Name, "_") {
+			return "", &apiError{9101, "SRV record name must begin with _service._proto."}
+		}
+		prio := uint16(dataInt(d, "priority"))
+		rec.Priority = &prio
+		return fmt.Sprintf("%d %d %s", dataInt(d, "weight"), dataInt(d, "port"), dataString(d, "target")), nil
+	case "CAA":
+		if dataString(d, "tag") == "" {
+			return "", invalid
+		}
+		return fmt.Sprintf("%d %s %q", dataInt(d, "flags"), dataString(d, "tag"), dataString(d, "value")), nil
+	case "HTTPS", "SVCB":
+		content := fmt.Sprintf("%d %s %s", dataInt(d, "priority"), dataString(d, "target"), dataString(d, "value"))
+		return strings.TrimSpace(content), nil
+	case "LOC":
+		if !hasData(d, "lat_degrees", "lat_direction", "long_degrees", "long_direction", "altitude") {
+			return "", invalid
+		}
+		return fmt.Sprintf("%d %d %s %s %d %d %s %s %sm %sm %sm %sm",
+			dataInt(d, "lat_degrees"), dataInt(d, "lat_minutes"), dataString(d, "lat_seconds"), dataString(d, "lat_direction"),
+			dataInt(d, "long_degrees"), dataInt(d, "long_minutes"), dataString(d, "long_seconds"), dataString(d, "long_direction"),
+			dataString(d, "altitude"), dataString(d, "size"), dataString(d, "precision_horz"), dataString(d, "precision_vert")), nil
+	case "SSHFP":
+		if !hasData(d, "algorithm", "type", "fingerprint") {
+			return "", invalid
+		}
+		return fmt.Sprintf("%d %d %s", dataInt(d, "algorithm"), dataInt(d, "type"), dataString(d, "fingerprint")), nil
+	case "TLSA", "SMIMEA":
+		if !hasData(d, "usage", "selector", "matching_type", "certificate") {
+			return "", invalid
+		}
+		return fmt.Sprintf("%d %d %d %s", dataInt(d, "usage"), dataInt(d, "selector"), dataInt(d, "matching_type"), dataString(d, "certificate")), nil
+	case "CERT":
+		if !hasData(d, "type", "key_tag", "algorithm", "certificate") {
+			return "", invalid
+		}
+		return fmt.Sprintf("%d %d %d %s", dataInt(d, "type"), dataInt(d, "key_tag"), dataInt(d, "algorithm"), dataString(d, "certificate")), nil
+	case "DNSKEY":
+		if !hasData(d, "flags", "protocol", "algorithm", "public_key") {
+			return "", invalid
+		}
+		return fmt.Sprintf("%d %d %d %s", dataInt(d, "flags"), dataInt(d, "protocol"), dataInt(d, "algorithm"), dataString(d, "public_key")), nil
+	case "DS":
+		if !hasData(d, "key_tag", "algorithm", "digest_type", "digest") {
+			return "", invalid
+		}
+		return fmt.Sprintf("%d %d %d %s", dataInt(d, "key_tag"), dataInt(d, "algorithm"), dataInt(d, "digest_type"), dataString(d, "digest")), nil
+	case "NAPTR":
+		if !hasData(d, "order", "preference") {
+			return "", invalid
+		}
+		return fmt.Sprintf("%d %d %q %q %q %s", dataInt(d, "order"), dataInt(d, "preference"),
+			dataString(d, "flags"), dataString(d, "service"), dataString(d, "regex"), dataString(d, "replacement")), nil
+	case "URI":
+		if !hasData(d, "target") {
+			return "", invalid
+		}
+		return fmt.Sprintf("%d %q", dataInt(d, "weight"), dataString(d, "target")), nil
+	}
+	// types for which Cloudflare doesn't use structured data ignore it
+	rec.Data = nil
+	return rec.Content, nil
+}
+
+func dataInt(d map[string]any, key string) int {
+	switch v := d[key].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
+// txtStrings returns the character-strings in TXT record content, still
+// escaped. Unquoted content is a single string.
+func txtStrings(content string) []string {
+	if !strings.HasPrefix(content, `"`) {
+		return []string{content}
+	}
+	var strs []string
+	for i := 0; i < len(content); i++ {
+		if content[i] != '"' {
+			continue
+		}
+		start := i + 1
+		for i++; i < len(content) && content[i] != '"'; i++ {
+			if content[i] == '\\' {
+				i++
+			}
+		}
+		if i > len(content) {
+			i = len(content) // trailing backslash
+		}
+		strs = append(strs, unescape(content[start:i]))
+	}
+	return strs
+}
+
+// unescape resolves the \X and \DDD escapes in a character-string.
+func unescape(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			n, _ := strconv.Atoi(s[i+1 : i+4])
+			sb.WriteByte(byte(n))
+			i += 3
+			continue
+		}
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// hasData returns true if all of the keys are in d.
+func hasData(d map[string]any, keys ...string) bool {
+	for _, key := range keys {
+		if _, ok := d[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func dataString(d map[string]any, key string) string {
+	switch v := d[key].(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func metaBool(meta map[string]any, key string) bool {
+	b, _ := meta[key].(bool)
+	return b
+}
+
+func priorityOf(rec Record) int {
+	if rec.Priority == nil {
+		return -1
+	}
+	return int(*rec.Priority)
+}
+
+var errRecordLocked = apiError{1046, "This record is managed by Cloudflare and cannot be modified or deleted."}
+
+// recordFilter is a parsed set of filters from a list request's query string.
+type recordFilter struct {
+	conds    []func(Record) bool
+	matchAny bool
+}
+
+func (f recordFilter) match(rec Record) bool {
+	if len(f.conds) == 0 {
+		return true
+	}
+	for _, cond := range f.conds {
+		ok := cond(rec)
+		if ok && f.matchAny {
+			return true
+		}
+		if !ok && !f.matchAny {
+			return false
+		}
+	}
+	return !f.matchAny
+}
+
+func parseRecordFilter(q map[string][]string, z *zone) (recordFilter, *apiError) {
+	var f recordFilter
+	var tagConds []func(Record) bool
+
+	switch m := first(q, "match"); m {
+	case "", "all":
+	case "any":
+		f.matchAny = true
+	default:
+		return f, &apiError{1004, fmt.Sprintf("Invalid match value %q", m)}
+	}
+	tagMatchAny := false
+	switch m := first(q, "tag_match"); m {
+	case "", "all":
+	case "any":
+		tagMatchAny = true
+	default:
+		return f, &apiError{1004, fmt.Sprintf("Invalid tag_match value %q", m)}
+	}
+
+	for key, vals := range q {
+		for _, val := range vals {
+			val := val
+			field, op := key, "exact"
+			if i := strings.Index(key, "."); i > 0 {
+				field, op = key[:i], key[i+1:]
+			}
+
+			switch field {
+			case "type":
+				f.conds = append(f.conds, func(r Record) bool { return strings.EqualFold(r.Type, val) })
+			case "name":
+				if op == "exact" {
+					val = z.absoluteName(val)
+				}
+				cond, ok := stringCond(op, val, false)
+				if !ok {
+					return f, &apiError{1004, fmt.Sprintf("Invalid filter %s", key)}
+				}
+				f.conds = append(f.conds, func(r Record) bool { return cond(r.Name) })
+			case "content":
+				cond, ok := stringCond(op, val, true)
+				if !ok {
+					return f, &apiError{1004, fmt.Sprintf("Invalid filter %s", key)}
+				}
+				f.conds = append(f.conds, func(r Record) bool { return cond(r.Content) })
+			case "comment":
+				switch op {
+				case "present":
+					f.conds = append(f.conds, func(r Record) bool { return r.Comment != nil && *r.Comment != "" })
+				case "absent":
+					f.conds = append(f.conds, func(r Record) bool { return r.Comment == nil || *r.Comment == "" })
+				default:
+					cond, ok := stringCond(op, val, false)
+					if !ok {
+						return f, &apiError{1004, fmt.Sprintf("Invalid filter %s", key)}
+					}
+					f.conds = append(f.conds, func(r Record) bool { return r.Comment != nil && cond(*r.Comment) })
+				}
+			case "proxied":
+				want := val == "true"
+				f.conds = append(f.conds, func(r Record) bool { return r.Proxied == want })
+			case "tag":
+				cond, apiErr := tagCond(op, val)
+				if apiErr != nil {
+					return f, apiErr
+				}
+				tagConds = append(tagConds, cond)
+			}
+		}
+	}
+
+	if len(tagConds) > 0 {
+		tf := recordFilter{conds: tagConds, matchAny: tagMatchAny}
+		f.conds = append(f.conds, tf.match)
+	}
+	return f, nil
+}
+
+// stringCond returns a predicate for the given filter operator.
+func stringCond(op, val string, caseSensitiveExact bool) (func(string) bool, bool) {
+	lower := strings.ToLower(val)
+	switch op {
+	case "exact":
+		if caseSensitiveExact {
+			return func(s string) bool { return s == val }, true
+		}
+		return func(s string) bool { return strings.EqualFold(s, val) }, true
+	case "contains":
+		return func(s string) bool { return strings.Contains(strings.ToLower(s), lower) }, true
+	case "startswith":
+		return func(s string) bool { return strings.HasPrefix(strings.ToLower(s), lower) }, true
+	case "endswith":
+		return func(s string) bool { return strings.HasSuffix(strings.ToLower(s), lower) }, true
+	}
+	return nil, false
+}
+
+// tagCond returns a predicate for a tag filter. Tags are "name:value"
+// pairs (or just "name"); a bare "tag=name" matches any tag with that name.
+func tagCond(op, val string) (func(Record) bool, *apiError) {
+	hasTag := func(r Record, pred func(name, value string) bool) bool {
+		for _, t := range r.Tags {
+			name, value := t, ""
+			if i := strings.Index(t, ":"); i >= 0 {
+				name, value = t[:i], t[i+1:]
+			}
+			if pred(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+	switch op {
+	case "exact":
+		return func(r Record) bool {
+			return hasTag(r, func(name, value string) bool {
+				if strings.Contains(val, ":") {
+					return name+":"+value == val
+				}
+				return name == val
+			})
+		}, nil
+	case "present":
+		return func(r Record) bool {
+			return hasTag(r, func(name, _ string) bool { return name == val })
+		}, nil
+	case "absent":
+		return func(r Record) bool {
+			return !hasTag(r, func(name, _ string) bool { return name == val })
+		}, nil
+	case "contains", "startswith", "endswith":
+		// the value is "name:substring"
+		name, sub := val, ""
+		if i := strings.Index(val, ":"); i >= 0 {
+			name, sub = val[:i], val[i+1:]
+		}
+		cond, _ := stringCond(op, sub, false)
+		return func(r Record) bool {
+			return hasTag(r, func(n, v string) bool { return n == name && cond(v) })
+		}, nil
+	}
+	return nil, &apiError{1004, fmt.Sprintf("Invalid filter tag.%s", op)}
+}
+
+func sortRecords(recs []Record, order, direction string) *apiError {
+	var less func(a, b Record) bool
+	switch order {
+	case "":
+		return nil
+	case "type":
+		less = func(a, b Record) bool { return a.Type < b.Type }
+	case "name":
+		less = func(a, b Record) bool { return a.Name < b.Name }
+	case "content":
+		less = func(a, b Record) bool { return a.Content < b.Content }
+	case "ttl":
+		less = func(a, b Record) bool { return a.TTL < b.TTL }
+	case "proxied":
+		less = func(a, b Record) bool { return !a.Proxied && b.Proxied }
+	default:
+		return &apiError{1004, fmt.Sprintf("Invalid order %q", order)}
+	}
+	switch direction {
+	case "", "asc":
+	case "desc":
+		asc := less
+		less = func(a, b Record) bool { return asc(b, a) }
+	default:
+		return &apiError{1004, fmt.Sprintf("Invalid direction %q", direction)}
+	}
+	sort.SliceStable(recs, func(i, j int) bool { return less(recs[i], recs[j]) })
+	return nil
+}
@@ -0,0 +1,579 @@
+// Package cloudflaretest provides an in-memory fake of the parts of the
+// Cloudflare API used by the cloudflare libdns provider, for testing
+// without a real account, token, or network access.
+//
+// The fake implements the /zones and /zones/{id}/dns_records endpoints
+// (listing with pagination and filters, create, update, delete, batch,
+// and export), wraps responses in Cloudflare's standard envelope, returns
+// Cloudflare's error codes for common failures, and mimics Cloudflare's
+// handling of names and record content closely enough for the libdns
+// test suite to run against it.
+package cloudflaretest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a fake Cloudflare API server. Its URL can be used as the
+// provider's BaseURL. The zero value is not usable; use NewServer.
+type Server struct {
+	*httptest.Server
+
+	// Token, if set, is the only API token the server accepts.
+	Token string
+
+	// If true, the batch endpoint responds as if it does not exist.
+	DisableBatch bool
+
+	mu       sync.Mutex
+	zones    []*zone
+	nextID   int
+	requests []string
+	failures []injectedFailure
+}
+
+type injectedFailure struct {
+	status     int
+	retryAfter string
+}
+
+// NewServer starts and returns a new fake server with no zones.
+// Callers should call Close when finished.
+func NewServer() *Server {
+	s := new(Server)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// AddZone adds an active zone with the given name to the server and
+// returns its ID.
+func (s *Server) AddZone(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	z := &zone{
+		ID:          s.newID(),
+		Name:        normalizeName(name),
+		Status:      "active",
+		Type:        "full",
+		NameServers: []string{"ada.ns.cloudflare.com", "bob.ns.cloudflare.com"},
+		CreatedOn:   now,
+		ModifiedOn:  now,
+		ActivatedOn: now,
+	}
+	z.Account.ID = "0123456789abcdef0123456789abcdef"
+	z.Account.Name = "Test Account"
+	z.Plan.ID = "0feeeeeeeeeeeeeeeeeeeeeeeeeeeeee"
+	z.Plan.Name = "Free Website"
+	s.zones = append(s.zones, z)
+	return z.ID
+}
+
+// RemoveZone removes the named zone and all its records from the server.
+func (s *Server) RemoveZone(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name = normalizeName(name)
+	for i, z := range s.zones {
+		if z.Name == name {
+			s.zones = append(s.zones[:i], s.zones[i+1:]...)
+			return
+		}
+	}
+}
+
+// AddRecord adds rec to the named zone as-is, bypassing validation, and
+// returns the stored record. It is useful for seeding records with
+// attributes that can't be set through the API, such as Locked or Meta.
+// If rec.ID is empty, one is assigned.
+func (s *Server) AddRecord(zoneName string, rec Record) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z := s.zoneByName(zoneName)
+	if z == nil {
+		return Record{}, fmt.Errorf("no zone named %s", zoneName)
+	}
+	if rec.ID == "" {
+		rec.ID = s.newID()
+	}
+	rec.Name = z.absoluteName(rec.Name)
+	rec.ZoneID, rec.ZoneName = z.ID, z.Name
+	if rec.CreatedOn.IsZero() {
+		rec.CreatedOn = time.Now().UTC()
+		rec.ModifiedOn = rec.CreatedOn
+	}
+	z.Records = append(z.Records, rec)
+	return rec, nil
+}
+
+// RemoveRecord removes the record with the given ID from the named zone,
+// as if it had been deleted by someone else.
+func (s *Server) RemoveRecord(zoneName, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z := s.zoneByName(zoneName)
+	if z == nil {
+		return
+	}
+	if idx := z.recordIndex(id); idx >= 0 {
+		z.Records = append(z.Records[:idx], z.Records[idx+1:]...)
+	}
+}
+
+// Records returns a copy of all the records in the named zone.
+func (s *Server) Records(zoneName string) []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z := s.zoneByName(zoneName)
+	if z == nil {
+		return nil
+	}
+	return append([]Record(nil), z.Records...)
+}
+
+// Requests returns the method and path of every request the server has
+// received so far, in order, like "GET /zones/abc/dns_records".
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// InjectFailures makes the next n requests fail with the given HTTP
+// status code. If retryAfter is not empty, it is sent as the value of
+// the Retry-After header.
+func (s *Server) InjectFailures(n, status int, retryAfter string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.failures = append(s.failures, injectedFailure{status, retryAfter})
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/client/v4")
+	s.requests = append(s.requests, r.Method+" "+path)
+
+	if len(s.failures) > 0 {
+		f := s.failures[0]
+		s.failures = s.failures[1:]
+		if f.retryAfter != "" {
+			w.Header().Set("Retry-After", f.retryAfter)
+		}
+		code := 0
+		if f.status == http.StatusTooManyRequests {
+			code = 10429
+		}
+		writeError(w, f.status, apiError{code, http.StatusText(f.status)})
+		return
+	}
+
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		writeError(w, http.StatusForbidden, errAuthentication)
+		return
+	}
+
+	// path segments after "/zones"
+	segs := strings.Split(strings.Trim(path, "/"), "/")
+	if segs[0] != "zones" {
+		writeError(w, http.StatusNotFound, errNoRoute)
+		return
+	}
+	segs = segs[1:]
+
+	if len(segs) == 0 {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+			return
+		}
+		s.listZones(w, r)
+		return
+	}
+
+	z := s.zoneByID(segs[0])
+	if z == nil {
+		writeError(w, http.StatusNotFound, apiError{7003, fmt.Sprintf("Could not route to %s, perhaps your object identifier is invalid?", path)})
+		return
+	}
+
+	switch {
+	case len(segs) == 1 && r.Method == http.MethodGet:
+		writeResult(w, z, nil)
+	case len(segs) == 2 && segs[1] == "dns_records" && r.Method == http.MethodGet:
+		s.listRecords(w, r, z)
+	case len(segs) == 2 && segs[1] == "dns_records" && r.Method == http.MethodPost:
+		s.createRecord(w, r, z)
+	case len(segs) == 3 && segs[1] == "dns_records" && segs[2] == "batch":
+		if s.DisableBatch {
+			writeError(w, http.StatusNotFound, errNoRoute)
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+			return
+		}
+		s.batch(w, r, z)
+	case len(segs) == 3 && segs[1] == "dns_records" && segs[2] == "export":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+			return
+		}
+		s.export(w, z)
+	case len(segs) == 3 && segs[1] == "dns_records":
+		s.recordByID(w, r, z, segs[2])
+	default:
+		writeError(w, http.StatusNotFound, errNoRoute)
+	}
+}
+
+func (s *Server) listZones(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var matches []*zone
+	for _, z := range s.zones {
+		if name := q.Get("name"); name != "" && normalizeName(name) != z.Name {
+			continue
+		}
+		if status := q.Get("status"); status != "" && status != z.Status {
+			continue
+		}
+		if typ := q.Get("type"); typ != "" && typ != z.Type {
+			continue
+		}
+		if acct := q.Get("account.id"); acct != "" && acct != z.Account.ID {
+			continue
+		}
+		matches = append(matches, z)
+	}
+	page, info, err := paginate(q, len(matches), 20, 50)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, *err)
+		return
+	}
+	writeResult(w, matches[page[0]:page[1]], info)
+}
+
+func (s *Server) listRecords(w http.ResponseWriter, r *http.Request, z *zone) {
+	q := r.URL.Query()
+	filter, apiErr := parseRecordFilter(q, z)
+	if apiErr != nil {
+		writeError(w, http.StatusBadRequest, *apiErr)
+		return
+	}
+	matches := make([]Record, 0)
+	for _, rec := range z.Records {
+		if filter.match(rec) {
+			matches = append(matches, rec)
+		}
+	}
+	if apiErr := sortRecords(matches, q.Get("order"), q.Get("direction")); apiErr != nil {
+		writeError(w, http.StatusBadRequest, *apiErr)
+		return
+	}
+	page, info, apiErr := paginate(q, len(matches), 100, 5000000)
+	if apiErr != nil {
+		writeError(w, http.StatusBadRequest, *apiErr)
+		return
+	}
+	writeResult(w, matches[page[0]:page[1]], info)
+}
+
+// export writes the records of the zone as a BIND zone file, in the
+// style of Cloudflare's export: fully qualified names, a comment before
+// the records of each type, and the proxy status in trailing comments.
+func (s *Server) export(w http.ResponseWriter, z *zone) {
+	recs := append([]Record(nil), z.Records...)
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].Type < recs[j].Type })
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, ";;\n;; Domain:     %s.\n;; Exported:   %s\n;;\n\n", z.Name, time.Now().UTC().Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(&sb, ";; SOA Record\n%s.\t3600\tIN\tSOA\t%s. dns.cloudflare.com. 2050000000 10000 2400 604800 3600\n", z.Name, z.NameServers[0])
+	for i, rec := range recs {
+		if i == 0 || rec.Type != recs[i-1].Type {
+			fmt.Fprintf(&sb, "\n;; %s Records\n", rec.Type)
+		}
+		content := rec.Content
+		switch rec.Type {
+		case "CNAME", "MX", "NS", "SRV":
+			if !strings.HasSuffix(content, ".") {
+				content += "."
+			}
+		}
+		if rec.Priority != nil {
+			content = fmt.Sprintf("%d %s", *rec.Priority, content)
+		}
+		fmt.Fprintf(&sb, "%s.\t%d\tIN\t%s\t%s", rec.Name, rec.TTL, rec.Type, content)
+		if rec.Proxiable {
+			fmt.Fprintf(&sb, " ; cf_tags=cf-proxied:%t", rec.Proxied)
+		}
+		sb.WriteString("\n")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("CF-Ray", "0123456789abcdef-SJC")
+	_, _ = w.Write([]byte(sb.String()))
+}
+
+func (s *Server) createRecord(w http.ResponseWriter, r *http.Request, z *zone) {
+	var input Record
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, http.StatusBadRequest, apiError{9207, "Request body is invalid."})
+		return
+	}
+	rec, apiErr := s.create(z, input)
+	if apiErr != nil {
+		writeError(w, http.StatusBadRequest, *apiErr)
+		return
+	}
+	writeResult(w, rec, nil)
+}
+
+func (s *Server) recordByID(w http.ResponseWriter, r *http.Request, z *zone, id string) {
+	idx := z.recordIndex(id)
+	if idx < 0 {
+		writeError(w, http.StatusNotFound, errRecordNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeResult(w, z.Records[idx], nil)
+
+	case http.MethodDelete:
+		if apiErr := s.delete(z, id); apiErr != nil {
+			writeError(w, http.StatusBadRequest, *apiErr)
+			return
+		}
+		writeResult(w, map[string]string{"id": id}, nil)
+
+	case http.MethodPatch, http.MethodPut:
+		var input Record
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeError(w, http.StatusBadRequest, apiError{9207, "Request body is invalid."})
+			return
+		}
+		input.ID = id
+		rec, apiErr := s.update(z, input, r.Method == http.MethodPatch)
+		if apiErr != nil {
+			writeError(w, http.StatusBadRequest, *apiErr)
+			return
+		}
+		writeResult(w, rec, nil)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+	}
+}
+
+// batch executes a batch request atomically: if any operation fails,
+// the zone is left as it was.
+func (s *Server) batch(w http.ResponseWriter, r *http.Request, z *zone) {
+	var input struct {
+		Deletes []Record `json:"deletes"`
+		Patches []Record `json:"patches"`
+		Puts    []Record `json:"puts"`
+		Posts   []Record `json:"posts"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, http.StatusBadRequest, apiError{9207, "Request body is invalid."})
+		return
+	}
+	if n := len(input.Deletes) + len(input.Patches) + len(input.Puts) + len(input.Posts); n > MaxBatchSize {
+		writeError(w, http.StatusBadRequest, apiError{81061, fmt.Sprintf("Batch request contains %d operations, which exceeds the limit of %d.", n, MaxBatchSize)})
+		return
+	}
+
+	original := append([]Record(nil), z.Records...)
+	fail := func(apiErr *apiError) {
+		z.Records = original
+		status := http.StatusBadRequest
+		if *apiErr == errRecordNotFound {
+			status = http.StatusNotFound // like the real API
+		}
+		writeError(w, status, *apiErr)
+	}
+
+	type batchResult struct {
+		Deletes []Record `json:"deletes"`
+		Patches []Record `json:"patches"`
+		Puts    []Record `json:"puts"`
+		Posts   []Record `json:"posts"`
+	}
+	result := batchResult{
+		Deletes: []Record{},
+		Patches: []Record{},
+		Puts:    []Record{},
+		Posts:   []Record{},
+	}
+
+	for _, del := range input.Deletes {
+		idx := z.recordIndex(del.ID)
+		if idx < 0 {
+			fail(&errRecordNotFound)
+			return
+		}
+		rec := z.Records[idx]
+		if apiErr := s.delete(z, del.ID); apiErr != nil {
+			fail(apiErr)
+			return
+		}
+		result.Deletes = append(result.Deletes, rec)
+	}
+	for _, patch := range input.Patches {
+		rec, apiErr := s.update(z, patch, true)
+		if apiErr != nil {
+			fail(apiErr)
+			return
+		}
+		result.Patches = append(result.Patches, rec)
+	}
+	for _, put := range input.Puts {
+		rec, apiErr := s.update(z, put, false)
+		if apiErr != nil {
+			fail(apiErr)
+			return
+		}
+		result.Puts = append(result.Puts, rec)
+	}
+	for _, post := range input.Posts {
+		rec, apiErr := s.create(z, post)
+		if apiErr != nil {
+			fail(apiErr)
+			return
+		}
+		result.Posts = append(result.Posts, rec)
+	}
+
+	writeResult(w, result, nil)
+}
+
+// MaxBatchSize is the maximum number of operations the fake server
+// accepts in a single batch request.
+const MaxBatchSize = 200
+
+func (s *Server) zoneByID(id string) *zone {
+	for _, z := range s.zones {
+		if z.ID == id {
+			return z
+		}
+	}
+	return nil
+}
+
+func (s *Server) zoneByName(name string) *zone {
+	name = normalizeName(name)
+	for _, z := range s.zones {
+		if z.Name == name {
+			return z
+		}
+	}
+	return nil
+}
+
+func (s *Server) newID() string {
+	s.nextID++
+	return fmt.Sprintf("%032x", s.nextID)
+}
+
+// paginate returns the [start, end) bounds of the requested page of n
+// items, along with the result info to report.
+func paginate(q map[string][]string, n, defaultPerPage, maxPerPage int) ([2]int, *resultInfo, *apiError) {
+	page, perPage := 1, defaultPerPage
+	if v := first(q, "page"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 {
+			return [2]int{}, nil, &apiError{1004, "Invalid page number"}
+		}
+		page = p
+	}
+	if v := first(q, "per_page"); v != "" {
+		pp, err := strconv.Atoi(v)
+		if err != nil || pp < 1 {
+			return [2]int{}, nil, &apiError{1004, "Invalid per_page value"}
+		}
+		perPage = pp
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	start := (page - 1) * perPage
+	if start > n {
+		start = n
+	}
+	end := start + perPage
+	if end > n {
+		end = n
+	}
+	return [2]int{start, end}, &resultInfo{
+		Page:       page,
+		PerPage:    perPage,
+		Count:      end - start,
+		TotalCount: n,
+		TotalPages: (n + perPage - 1) / perPage,
+	}, nil
+}
+
+func first(q map[string][]string, key string) string {
+	if vals := q[key]; len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+type resultInfo struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Count      int `json:"count"`
+	TotalCount int `json:"total_count"`
+	TotalPages int `json:"total_pages"`
+}
+
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+var (
+	errAuthentication   = apiError{10000, "Authentication error"}
+	errNoRoute          = apiError{7000, "No route for that URI"}
+	errMethodNotAllowed = apiError{10405, "Method not allowed"}
+	errRecordNotFound   = apiError{81044, "Record does not exist."}
+	errIdenticalRecord  = apiError{81058, "An identical record already exists."}
+	errCNAMEConflict    = apiError{81053, "An A, AAAA, or CNAME record with that host already exists."}
+)
+
+func writeResult(w http.ResponseWriter, result any, info *resultInfo) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"result":      result,
+		"success":     true,
+		"errors":      []apiError{},
+		"messages":    []any{},
+		"result_info": info,
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, errs ...apiError) {
+	writeJSON(w, status, map[string]any{
+		"result":   nil,
+		"success":  false,
+		"errors":   errs,
+		"messages": []any{},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("CF-Ray", "0123456789abcdef-SJC")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,261 @@
+package cloudflare
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/libdns/libdns"
+)
+
+// Sentinel errors that an *APIError can be compared to with errors.Is,
+// to find out what went wrong without depending on specific error codes.
+var (
+	// ErrRecordExists means an identical record already exists.
+	ErrRecordExists = errors.New("record already exists")
+
+	// ErrUnauthorized means the API token is invalid or lacks the
+	// permissions needed for the request.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrRateLimited means the request was rejected because too many
+	// requests have been made with the same token.
+	ErrRateLimited = errors.New("rate limited")
+
+	// ErrZoneNotFound means the zone does not exist, or is not
+	// accessible with the API token.
+	ErrZoneNotFound = errors.New("zone not found")
+
+	// ErrProtectedRecord means a record could not be changed because
+	// Cloudflare manages it or doesn't allow changing it. It is matched
+	// by a *ProtectedRecordError.
+	ErrProtectedRecord = errors.New("record is protected")
+)
+
+// APIError is the error returned when the Cloudflare API responds to a
+// request with an error. Use errors.As to access it, or errors.Is to
+// compare it with the sentinel errors in this package.
+type APIError struct {
+	// The HTTP status code of the response.
+	StatusCode int
+
+	// The method and URL path of the request.
+	Method string
+	Path   string
+
+	// The value of the CF-Ray response header, which identifies
+	// the request to Cloudflare support.
+	RayID string
+
+	// The errors reported in the response body, if any.
+	Errors []ErrorDetail
+}
+
+// ErrorDetail is an individual error reported by the Cloudflare API.
+type ErrorDetail struct {
+	Code       int           `json:"code"`
+	Message    string        `json:"message"`
+	ErrorChain []ErrorDetail `json:"error_chain,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s: HTTP %d", e.Method, e.Path, e.StatusCode)
+	for i, detail := range e.Errors {
+		if i == 0 {
+			sb.WriteString(": ")
+		} else {
+			sb.WriteString("; ")
+		}
+		writeErrorDetail(&sb, detail)
+	}
+	if e.RayID != "" {
+		fmt.Fprintf(&sb, " (CF-Ray: %s)", e.RayID)
+	}
+	return sb.String()
+}
+
+func writeErrorDetail(sb *strings.Builder, detail ErrorDetail) {
+	fmt.Fprintf(sb, "%s (%d)", detail.Message, detail.Code)
+	for _, cause := range detail.ErrorChain {
+		sb.WriteString(": ")
+		writeErrorDetail(sb, cause)
+	}
+}
+
+// Codes returns all the Cloudflare error codes in the response,
+// including those in error chains.
+func (e *APIError) Codes() []int {
+	var codes []int
+	var walk func([]ErrorDetail)
+	walk = func(details []ErrorDetail) {
+		for _, d := range details {
+			codes = append(codes, d.Code)
+			walk(d.ErrorChain)
+		}
+	}
+	walk(e.Errors)
+	return codes
+}
+
+// HasCode returns true if the response contains the given Cloudflare
+// error code, including in error chains.
+func (e *APIError) HasCode(code int) bool {
+	return containsInt(e.Codes(), code)
+}
+
+// Is reports whether the error matches one of the sentinel errors in
+// this package.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrRecordExists:
+		return e.hasAnyCode(recordExistsCodes)
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized ||
+			e.StatusCode == http.StatusForbidden ||
+			e.hasAnyCode(unauthorizedCodes)
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests ||
+			e.hasAnyCode(rateLimitedCodes)
+	case ErrZoneNotFound:
+		// an invalid identifier may be the zone's or another object's
+		return e.hasAnyCode(zoneNotFoundCodes) ||
+			(e.HasCode(invalidIdentifierCode) && onlyZoneIdentifier(e.Path))
+	}
+	return false
+}
+
+func (e *APIError) hasAnyCode(codes []int) bool {
+	for _, code := range e.Codes() {
+		if containsInt(codes, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cloudflare error codes that correspond to the sentinel errors.
+var (
+	recordExistsCodes = []int{
+		81057, // "Record already exists."
+		81058, // "An identical record already exists."
+	}
+	unauthorizedCodes = []int{
+		9109,  // "Invalid access token"
+		10000, // "Authentication error"
+		10001, // "Unable to authenticate request"
+	}
+	rateLimitedCodes = []int{
+		971,   // "Please wait and consider throttling your request speed"
+		10429, // "Too many requests"
+	}
+	zoneNotFoundCodes = []int{
+		1001, // "Invalid zone identifier"
+	}
+)
+
+// Cloudflare error codes for requests that can't be routed.
+const (
+	noRouteCode           = 7000 // "No route for that URI"
+	invalidIdentifierCode = 7003 // "Could not route to ..., perhaps your object identifier is invalid?"
+)
+
+// onlyZoneIdentifier returns true if the only object identifier in the
+// API request path is a zone ID, such as in /zones/{id}/dns_records (but
+// not /zones/{id}/dns_records/{id}).
+func onlyZoneIdentifier(path string) bool {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, seg := range segments {
+		if seg != "zones" {
+			continue
+		}
+		rest := segments[i+1:] // {id}/dns_records/...
+		if len(rest) < 3 || rest[1] != "dns_records" {
+			return len(rest) > 0
+		}
+		switch rest[2] {
+		case "batch", "export", "import":
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+// newAPIError returns an *APIError for the given response.
+func newAPIError(req *http.Request, resp *http.Response, details []ErrorDetail) *APIError {
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		RayID:      resp.Header.Get("CF-Ray"),
+		Errors:     details,
+	}
+}
+
+// PartialError is returned by methods that change several records when
+// they fail after some of the changes were already made, and the changes
+// were not (or could not be) rolled back. The method also returns the
+// applied records along with this error.
+type PartialError struct {
+	// The records that were created, updated, or deleted before
+	// the failure, and remain so.
+	Applied []libdns.Record
+
+	// The error that stopped the changes.
+	Err error
+
+	// The error that prevented rolling back the changes, if
+	// rollback was enabled. (Some changes may have been rolled back.)
+	RollbackErr error
+}
+
+func (e *PartialError) Error() string {
+	msg := fmt.Sprintf("failed after %d records were changed: %v", len(e.Applied), e.Err)
+	if e.RollbackErr != nil {
+		msg += fmt.Sprintf(" (rollback failed: %v)", e.RollbackErr)
+	}
+	return msg
+}
+
+func (e *PartialError) Unwrap() error { return e.Err }
+
+// ProtectedRecordError is returned by SetRecords and DeleteRecords when
+// they would change records that Cloudflare manages or doesn't allow
+// changing, and the provider is configured to refuse to (see the
+// ProtectedRecords field of Provider). No changes are made.
+type ProtectedRecordError struct {
+	Records []ProtectedRecord
+}
+
+// ProtectedRecord is a record that is protected from changes.
+type ProtectedRecord struct {
+	Record libdns.Record
+
+	// Why the record is protected, like "locked" or "read-only".
+	Reason string
+}
+
+func (e *ProtectedRecordError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "refusing to change %d protected records", len(e.Records))
+	for i, protected := range e.Records {
+		sep := ", "
+		if i == 0 {
+			sep = ": "
+		}
+		sb.WriteString(sep)
+		if protected.Record != nil {
+			rr := protected.Record.RR()
+			fmt.Fprintf(&sb, "%s %s ", rr.Name, rr.Type)
+		}
+		fmt.Fprintf(&sb, "(%s)", protected.Reason)
+	}
+	return sb.String()
+}
+
+// Is returns true if target is ErrProtectedRecord.
+func (e *ProtectedRecordError) Is(target error) bool {
+	return target == ErrProtectedRecord
+}
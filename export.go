@@ -0,0 +1,305 @@
+package cloudflare
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// ExportZone returns the records in the zone as a BIND zone file, as
+// exported by Cloudflare. Use ParseZoneFile to get libdns records from it.
+func (p *Provider) ExportZone(ctx context.Context, zone string) ([]byte, error) {
+	zoneInfo, err := p.getZoneInfo(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	reqURL := fmt.Sprintf("%s/zones/%s/dns_records/export", p.baseURL(), zoneInfo.ID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var zoneFile []byte
+	if _, err := p.doAPIRequest(req, &zoneFile); err != nil {
+		return nil, err
+	}
+	return zoneFile, nil
+}
+
+// ParseZoneFile parses a zone file for the zone, like one returned by
+// ExportZone, into libdns records with names relative to the zone, so
+// that they can be compared with the records returned by GetRecords or
+// given to another libdns provider. It supports the usual syntax of
+// BIND zone files: comments, parentheses, quoted strings, $ORIGIN and
+// $TTL directives, and omitted owner names, TTLs, and classes ($INCLUDE
+// is not supported). Relative names are qualified with the origin, both
+// owner names and the targets of CNAME, NS, MX, and SRV records. SOA
+// records are skipped, since they can't be managed with libdns, and a TTL
+// of 1 second is taken to be Cloudflare's automatic TTL, so it becomes 0,
+// like in records from GetRecords.
+func ParseZoneFile(zone string, r io.Reader) ([]libdns.Record, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := zoneFileEntries(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	zoneFQDN := normalizeDomain(zone) + "."
+	origin := zoneFQDN
+	var owner string
+	var ttl, defaultTTL time.Duration
+	var haveDefaultTTL bool
+
+	var recs []libdns.Record
+	for _, entry := range entries {
+		tokens := entry.tokens
+
+		if !entry.ownerOmitted && strings.HasPrefix(tokens[0], "$") {
+			if len(tokens) < 2 {
+				return nil, fmt.Errorf("line %d: %s requires an argument", entry.line, tokens[0])
+			}
+			switch strings.ToUpper(tokens[0]) {
+			case "$ORIGIN":
+				origin = strings.ToLower(absoluteZoneFileName(tokens[1], origin))
+			case "$TTL":
+				t, ok := parseZoneFileTTL(tokens[1])
+				if !ok {
+					return nil, fmt.Errorf("line %d: invalid TTL %q", entry.line, tokens[1])
+				}
+				defaultTTL, haveDefaultTTL = t, true
+			default:
+				return nil, fmt.Errorf("line %d: unsupported directive %s", entry.line, tokens[0])
+			}
+			continue
+		}
+
+		if !entry.ownerOmitted {
+			owner = strings.ToLower(absoluteZoneFileName(tokens[0], origin))
+			tokens = tokens[1:]
+		}
+		if owner == "" {
+			return nil, fmt.Errorf("line %d: missing owner name", entry.line)
+		}
+
+		// the TTL and class are optional, and may come in either order;
+		// without a TTL, the $TTL applies, or else the previous TTL
+		if haveDefaultTTL {
+			ttl = defaultTTL
+		}
+		for len(tokens) > 0 {
+			if t, ok := parseZoneFileTTL(tokens[0]); ok {
+				ttl = t
+			} else if !isZoneFileClass(tokens[0]) {
+				break
+			}
+			tokens = tokens[1:]
+		}
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("line %d: missing record type", entry.line)
+		}
+
+		typ := strings.ToUpper(tokens[0])
+		if typ == "SOA" {
+			continue
+		}
+		name := libdns.RelativeName(owner, zoneFQDN)
+		rec, err := zoneFileRecord(name, libdnsTTL(int(ttl/time.Second)), typ, strings.Join(tokens[1:], " "), origin)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", entry.line, err)
+		}
+		recs = append(recs, rec)
+	}
+
+	return recs, nil
+}
+
+// zoneFileRecord returns the record with the given data, which is in
+// presentation format. Relative domain names in the data are qualified
+// with origin, like owner names.
+func zoneFileRecord(name string, ttl time.Duration, typ, data, origin string) (libdns.Record, error) {
+	switch typ {
+	case "TXT":
+		// libdns has the text itself, unquoted and unescaped
+		return libdns.TXT{Name: name, TTL: ttl, Text: unwrapContent(data)}, nil
+	case "CAA":
+		flags, tag, value, err := parseCAA(data)
+		if err != nil {
+			return nil, err
+		}
+		return libdns.CAA{Name: name, TTL: ttl, Flags: flags, Tag: tag, Value: value}, nil
+	}
+	rec, err := libdns.RR{Name: name, TTL: ttl, Type: typ, Data: data}.Parse()
+	if err != nil {
+		return nil, err
+	}
+	switch rec := rec.(type) {
+	case libdns.CNAME:
+		rec.Target = absoluteZoneFileName(rec.Target, origin)
+		return rec, nil
+	case libdns.NS:
+		rec.Target = absoluteZoneFileName(rec.Target, origin)
+		return rec, nil
+	case libdns.MX:
+		rec.Target = absoluteZoneFileName(rec.Target, origin)
+		return rec, nil
+	case libdns.SRV:
+		rec.Target = absoluteZoneFileName(rec.Target, origin)
+		return rec, nil
+	}
+	return rec, nil
+}
+
+// zoneFileEntry is a single entry (a directive or a record) in a zone file.
+type zoneFileEntry struct {
+	tokens       []string // quoted strings keep their quotes and escapes
+	ownerOmitted bool     // if the entry starts with whitespace
+	line         int
+}
+
+// zoneFileEntries splits a zone file into its entries, without comments.
+func zoneFileEntries(data string) ([]zoneFileEntry, error) {
+	var entries []zoneFileEntry
+	cur := zoneFileEntry{line: 1}
+	var tok strings.Builder
+	inTok, quoted, parens, line, lineStart := false, false, 0, 1, true
+
+	endTok := func() {
+		if inTok {
+			cur.tokens = append(cur.tokens, tok.String())
+			tok.Reset()
+			inTok = false
+		}
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if lineStart && parens == 0 && (c == ' ' || c == '\t') {
+			cur.ownerOmitted = true
+		}
+		lineStart = false
+
+		switch {
+		case c == '\\' && i+1 < len(data):
+			tok.WriteByte(c)
+			tok.WriteByte(data[i+1])
+			inTok = true
+			i++
+		case c == '"':
+			tok.WriteByte(c)
+			quoted = !quoted
+			inTok = true
+		case quoted:
+			if c == '\n' {
+				return nil, fmt.Errorf("line %d: unterminated quoted string", line)
+			}
+			tok.WriteByte(c)
+		case c == ';':
+			for i+1 < len(data) && data[i+1] != '\n' {
+				i++
+			}
+		case c == '(':
+			endTok()
+			parens++
+		case c == ')':
+			if parens == 0 {
+				return nil, fmt.Errorf("line %d: unbalanced parentheses", line)
+			}
+			endTok()
+			parens--
+		case c == '\n':
+			endTok()
+			line++
+			lineStart = true
+			if parens == 0 {
+				if len(cur.tokens) > 0 {
+					entries = append(entries, cur)
+				}
+				cur = zoneFileEntry{line: line}
+			}
+		case c == ' ' || c == '\t' || c == '\r':
+			endTok()
+		default:
+			tok.WriteByte(c)
+			inTok = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("line %d: unterminated quoted string", line)
+	}
+	if parens > 0 {
+		return nil, fmt.Errorf("line %d: unbalanced parentheses", line)
+	}
+	endTok()
+	if len(cur.tokens) > 0 {
+		entries = append(entries, cur)
+	}
+	return entries, nil
+}
+
+// absoluteZoneFileName returns name, from a zone file, as a fully
+// qualified domain name, using origin for "@" and relative names.
+func absoluteZoneFileName(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return name
+	case origin == ".":
+		return name + "."
+	}
+	return name + "." + origin
+}
+
+// parseZoneFileTTL parses a TTL in a zone file, which is a number of
+// seconds, or a duration with the units w, d, h, m, and s (like 1h30m).
+func parseZoneFileTTL(s string) (time.Duration, bool) {
+	if n, err := strconv.ParseUint(s, 10, 31); err == nil {
+		return time.Duration(n) * time.Second, true
+	}
+	units := map[byte]time.Duration{
+		'w': 7 * 24 * time.Hour,
+		'd': 24 * time.Hour,
+		'h': time.Hour,
+		'm': time.Minute,
+		's': time.Second,
+	}
+	var ttl time.Duration
+	var n int64
+	haveDigits := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= '0' && c <= '9' {
+			n = n*10 + int64(c-'0')
+			haveDigits = true
+			continue
+		}
+		unit, ok := units[c|0x20] // (lowercase)
+		if !ok || !haveDigits {
+			return 0, false
+		}
+		ttl += time.Duration(n) * unit
+		n, haveDigits = 0, false
+	}
+	if haveDigits {
+		return 0, false // a number must have a unit if any does
+	}
+	return ttl, len(s) > 0
+}
+
+func isZoneFileClass(s string) bool {
+	switch strings.ToUpper(s) {
+	case "IN", "CH", "HS", "CS":
+		return true
+	}
+	return false
+}
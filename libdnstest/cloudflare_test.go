@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/libdns/cloudflare"
+	"github.com/libdns/cloudflare/cloudflaretest"
 	"github.com/libdns/libdns/libdnstest"
 )
 
@@ -30,3 +31,20 @@ func TestCloudflareProvider(t *testing.T) {
 	suite := libdnstest.NewTestSuite(provider, testZone)
 	suite.RunTests(t)
 }
+
+func TestFakeCloudflareProvider(t *testing.T) {
+	const testZone = "example.com."
+
+	srv := cloudflaretest.NewServer()
+	defer srv.Close()
+	srv.Token = "fake-token"
+	srv.AddZone(testZone)
+
+	provider := &cloudflare.Provider{
+		APIToken: "fake-token",
+		BaseURL:  srv.URL,
+	}
+
+	suite := libdnstest.NewTestSuite(provider, testZone)
+	suite.RunTests(t)
+}
@@ -52,73 +52,142 @@ type cfZone struct {
 }
 
 type cfDNSRecord struct {
-	ID         string    `json:"id,omitempty"`
-	Type       string    `json:"type,omitempty"`
-	Name       string    `json:"name,omitempty"`
-	Content    string    `json:"content,omitempty"`
-	Priority   uint16    `json:"priority,omitempty"`
-	Proxiable  bool      `json:"proxiable,omitempty"`
-	Proxied    bool      `json:"proxied,omitempty"`
-	TTL        int       `json:"ttl,omitempty"` // seconds
-	Locked     bool      `json:"locked,omitempty"`
-	ZoneID     string    `json:"zone_id,omitempty"`
-	ZoneName   string    `json:"zone_name,omitempty"`
-	CreatedOn  time.Time `json:"created_on,omitempty"`
-	ModifiedOn time.Time `json:"modified_on,omitempty"`
-	Data       struct {
-		// LOC
-		LatDegrees    int    `json:"lat_degrees,omitempty"`
-		LatMinutes    int    `json:"lat_minutes,omitempty"`
-		LatSeconds    int    `json:"lat_seconds,omitempty"`
-		LatDirection  string `json:"lat_direction,omitempty"`
-		LongDegrees   int    `json:"long_degrees,omitempty"`
-		LongMinutes   int    `json:"long_minutes,omitempty"`
-		LongSeconds   int    `json:"long_seconds,omitempty"`
-		LongDirection string `json:"long_direction,omitempty"`
-		Altitude      int    `json:"altitude,omitempty"`
-		Size          int    `json:"size,omitempty"`
-		PrecisionHorz int    `json:"precision_horz,omitempty"`
-		PrecisionVert int    `json:"precision_vert,omitempty"`
+	ID         string            `json:"id,omitempty"`
+	Type       string            `json:"type,omitempty"`
+	Name       string            `json:"name,omitempty"`
+	Content    string            `json:"content,omitempty"`
+	Priority   uint16            `json:"priority,omitempty"`
+	Proxiable  bool              `json:"proxiable,omitempty"`
+	Proxied    *bool             `json:"proxied,omitempty"`
+	TTL        int               `json:"ttl,omitempty"` // seconds
+	Locked     bool              `json:"locked,omitempty"`
+	ZoneID     string            `json:"zone_id,omitempty"`
+	ZoneName   string            `json:"zone_name,omitempty"`
+	CreatedOn  time.Time         `json:"created_on,omitempty"`
+	ModifiedOn time.Time         `json:"modified_on,omitempty"`
+	Comment    *string           `json:"comment,omitempty"`
+	Tags       *[]string         `json:"tags,omitempty"`
+	Settings   *cfRecordSettings `json:"settings,omitempty"`
+	Data       cfRecordData      `json:"data,omitempty"`
+	Meta       *struct {
+		AutoAdded    bool   `json:"auto_added,omitempty"`
+		Source       string `json:"source,omitempty"`
+		EmailRouting bool   `json:"email_routing,omitempty"`
+		ReadOnly     bool   `json:"read_only,omitempty"`
+	} `json:"meta,omitempty"`
+}
 
-		// SRV, HTTPS
-		Service  string `json:"service,omitempty"`
-		Proto    string `json:"proto,omitempty"`
-		Name     string `json:"name,omitempty"`
-		Priority uint16 `json:"priority,omitempty"`
-		Weight   uint16 `json:"weight,omitempty"`
-		Port     uint16 `json:"port,omitempty"`
-		Target   string `json:"target,omitempty"`
+// cfRecordData holds the structured data of records, which Cloudflare
+// uses (instead of the content) for some record types.
+type cfRecordData struct {
+	// LOC
+	LatDegrees    *int     `json:"lat_degrees,omitempty"`
+	LatMinutes    *int     `json:"lat_minutes,omitempty"`
+	LatSeconds    *float64 `json:"lat_seconds,omitempty"`
+	LatDirection  string   `json:"lat_direction,omitempty"`
+	LongDegrees   *int     `json:"long_degrees,omitempty"`
+	LongMinutes   *int     `json:"long_minutes,omitempty"`
+	LongSeconds   *float64 `json:"long_seconds,omitempty"`
+	LongDirection string   `json:"long_direction,omitempty"`
+	Altitude      *float64 `json:"altitude,omitempty"`
+	Size          *float64 `json:"size,omitempty"`
+	PrecisionHorz *float64 `json:"precision_horz,omitempty"`
+	PrecisionVert *float64 `json:"precision_vert,omitempty"`
 
-		// CAA, SRV, HTTPS
-		Value string `json:"value,omitempty"`
+	// SRV, HTTPS, NAPTR
+	Service string `json:"service,omitempty"`
+	// SRV, HTTPS
+	Proto    string `json:"proto,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Priority uint16 `json:"priority,omitempty"`
+	Port     uint16 `json:"port,omitempty"`
+	// SRV, HTTPS, URI
+	Weight uint16 `json:"weight,omitempty"`
+	Target string `json:"target,omitempty"`
 
-		// CAA
-		Tag string `json:"tag"`
+	// CAA, SRV, HTTPS
+	Value string `json:"value,omitempty"`
 
-		// CAA, DNSKEY
-		Flags *int `json:"flags,omitempty"`
-		// DNSKEY
-		Protocol  int `json:"protocol,omitempty"`
-		Algorithm int `json:"algorithm,omitempty"`
+	// CAA
+	Tag string `json:"tag"`
 
-		// DS
-		KeyTag     int `json:"key_tag,omitempty"`
-		DigestType int `json:"digest_type,omitempty"`
+	// CAA, DNSKEY (numbers), NAPTR (a string)
+	Flags any `json:"flags,omitempty"`
+	// DNSKEY
+	Protocol  *int   `json:"protocol,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+	// DNSKEY, DS, SSHFP, CERT
+	Algorithm *int `json:"algorithm,omitempty"`
 
-		// TLSA
-		Usage        int `json:"usage,omitempty"`
-		Selector     int `json:"selector,omitempty"`
-		MatchingType int `json:"matching_type,omitempty"`
+	// DS, CERT
+	KeyTag *int `json:"key_tag,omitempty"`
+	// DS
+	DigestType *int   `json:"digest_type,omitempty"`
+	Digest     string `json:"digest,omitempty"`
 
-		// URI
-		Content string `json:"content,omitempty"`
-	} `json:"data,omitempty"`
-	Meta *struct {
-		AutoAdded    bool   `json:"auto_added,omitempty"`
-		Source       string `json:"source,omitempty"`
-		EmailRouting bool   `json:"email_routing,omitempty"`
-		ReadOnly     bool   `json:"read_only,omitempty"`
-	} `json:"meta,omitempty"`
+	// TLSA, SMIMEA
+	Usage        *int `json:"usage,omitempty"`
+	Selector     *int `json:"selector,omitempty"`
+	MatchingType *int `json:"matching_type,omitempty"`
+	// TLSA, SMIMEA, CERT
+	Certificate string `json:"certificate,omitempty"`
+
+	// SSHFP, CERT
+	Type *int `json:"type,omitempty"`
+	// SSHFP
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// NAPTR
+	Order       *int   `json:"order,omitempty"`
+	Preference  *int   `json:"preference,omitempty"`
+	Regex       string `json:"regex,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// cfAutoTTL is the TTL that means "automatic" to Cloudflare, which is
+// also the TTL of all proxied records.
+const cfAutoTTL = 1
+
+// The range of TTLs (other than automatic) that Cloudflare accepts.
+const (
+	cfMinTTL = 60
+	cfMaxTTL = 86400
+)
+
+// cloudflareTTL converts a libdns TTL to a Cloudflare TTL. A zero (or
+// negative) TTL means automatic; others are rounded to the nearest
+// second and clamped to the range that Cloudflare accepts.
+func cloudflareTTL(ttl time.Duration) int {
+	if ttl <= 0 {
+		return cfAutoTTL
+	}
+	secs := int(ttl.Round(time.Second) / time.Second)
+	if secs < cfMinTTL {
+		return cfMinTTL
+	}
+	if secs > cfMaxTTL {
+		return cfMaxTTL
+	}
+	return secs
+}
+
+// libdnsTTL converts a Cloudflare TTL to a libdns TTL; automatic is 0.
+func libdnsTTL(ttl int) time.Duration {
+	if ttl == cfAutoTTL {
+		return 0
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// ttlDiffers returns true if r, as an update to existing, would change
+// its TTL. The TTL of proxied records is always automatic, so it doesn't
+// count.
+func (r cfDNSRecord) ttlDiffers(existing cfDNSRecord) bool {
+	proxied := derefBool(existing.Proxied)
+	if r.Proxied != nil {
+		proxied = *r.Proxied
+	}
+	return !proxied && r.TTL != existing.TTL
 }
 
 // ensureTrailingDot adds a trailing dot if not present
@@ -129,9 +198,20 @@ func ensureTrailingDot(s string) string {
 	return s
 }
 
+// libdnsRecord converts r to a libdns record, with the Cloudflare-specific
+// attributes of r in its ProviderData field.
 func (r cfDNSRecord) libdnsRecord(zone string) (libdns.Record, error) {
-	name := libdns.RelativeName(r.Name, zone)
-	ttl := time.Duration(r.TTL) * time.Second
+	rec, err := r.libdnsRecordData(zone)
+	if err != nil {
+		return rec, err
+	}
+	return withProviderData(rec, r.providerData()), nil
+}
+
+func (r cfDNSRecord) libdnsRecordData(zone string) (libdns.Record, error) {
+	// the API's names are normalized, so the zone must be too
+	name := libdns.RelativeName(r.Name, normalizeDomain(zone))
+	ttl := libdnsTTL(r.TTL)
 	switch r.Type {
 	case "A", "AAAA":
 		addr, err := netip.ParseAddr(r.Content)
@@ -147,14 +227,10 @@ func (r cfDNSRecord) libdnsRecord(zone string) (libdns.Record, error) {
 		// NOTE: CAA records from Cloudflare have a `r.Content` that can be
 		// parsed by [libdns.RR.Parse], but all the data we need is already sent
 		// to us in a structured format by Cloudflare, so we use that instead.
-		flags := uint8(0)
-		if r.Data.Flags != nil {
-			flags = uint8(*r.Data.Flags)
-		}
 		return libdns.CAA{
 			Name:  name,
 			TTL:   ttl,
-			Flags: flags,
+			Flags: uint8(anyInt(r.Data.Flags)),
 			Tag:   r.Data.Tag,
 			Value: r.Data.Value,
 		}, nil
@@ -205,6 +281,19 @@ func (r cfDNSRecord) libdnsRecord(zone string) (libdns.Record, error) {
 			TTL:  ttl,
 			Text: unwrappedContent,
 		}, nil
+	case "LOC", "SSHFP", "TLSA", "SMIMEA", "CERT", "DNSKEY", "DS", "NAPTR", "URI":
+		// Cloudflare sends the data of these in structured fields,
+		// which we put back together in presentation format
+		data, ok := r.structuredData()
+		if !ok {
+			data = r.Content
+		}
+		return libdns.RR{
+			Name: name,
+			TTL:  ttl,
+			Type: r.Type,
+			Data: data,
+		}.Parse()
 	// NOTE: HTTPS records from Cloudflare have a `r.Content` that can be
 	// parsed by [libdns.RR.Parse] so that is what we do here. While we are
 	// provided with structured data, it still requires a bit of parsing
@@ -249,17 +338,25 @@ func cloudflareRecord(r libdns.Record) (cfDNSRecord, error) {
 		// ID:   r.ID,
 		Name:    rr.Name,
 		Type:    rr.Type,
-		TTL:     int(rr.TTL.Seconds()),
+		TTL:     cloudflareTTL(rr.TTL),
 		Content: content,
 	}
+	if rr.Type == "CAA" {
+		if _, ok := r.(libdns.CAA); !ok {
+			// parse it ourselves; libdns doesn't handle all values
+			flags, tag, value, err := parseCAA(rr.Data)
+			if err != nil {
+				return cfDNSRecord{}, err
+			}
+			r = libdns.CAA{Name: rr.Name, TTL: rr.TTL, Flags: flags, Tag: tag, Value: value}
+		}
+	}
 	switch rec := r.(type) {
 	case libdns.CAA:
-		flags := int(rec.Flags)
-		cfRec.Data.Flags = &flags
+		cfRec.Data.Flags = int(rec.Flags)
 		cfRec.Data.Tag = rec.Tag
 		cfRec.Data.Value = rec.Value
-		// Use RR().Data which properly formats the content field
-		cfRec.Content = rec.RR().Data
+		cfRec.Content = fmt.Sprintf("%d %s %s", rec.Flags, rec.Tag, quoteField(rec.Value))
 	case libdns.MX:
 		cfRec.Priority = rec.Preference
 		// Content should be just the target, not include priority
@@ -290,8 +387,19 @@ func cloudflareRecord(r libdns.Record) (cfDNSRecord, error) {
 		// and doesn't seem to support content.exact filtering for these record types anyway
 		// for the same reason we can avoid dealing with dots in Target
 	}
-	if rr.Type == "CNAME" && strings.HasSuffix(cfRec.Content, ".cfargotunnel.com") {
-		cfRec.Proxied = true
+	if err := cfRec.setStructuredData(rr); err != nil {
+		return cfDNSRecord{}, err
+	}
+	if data, ok := providerDataOf(r); ok {
+		cfRec.setProviderData(data)
+	} else if rr.Type == "CNAME" && strings.HasSuffix(cfRec.Content, ".cfargotunnel.com") {
+		// tunnel CNAMEs only work when proxied
+		proxied := true
+		cfRec.Proxied = &proxied
+	}
+	if derefBool(cfRec.Proxied) {
+		// Cloudflare sets the TTL of proxied records itself
+		cfRec.TTL = cfAutoTTL
 	}
 	if rr.Type == "TXT" {
 		// wrap the content in quotes
@@ -302,18 +410,11 @@ func cloudflareRecord(r libdns.Record) (cfDNSRecord, error) {
 
 // All API responses have this structure.
 type cfResponse struct {
-	Result  json.RawMessage `json:"result,omitempty"`
-	Success bool            `json:"success"`
-	Errors  []struct {
-		Code       int    `json:"code"`
-		Message    string `json:"message"`
-		ErrorChain []struct {
-			Code    int    `json:"code"`
-			Message string `json:"message"`
-		} `json:"error_chain,omitempty"`
-	} `json:"errors,omitempty"`
-	Messages   []any         `json:"messages,omitempty"`
-	ResultInfo *cfResultInfo `json:"result_info,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Success    bool            `json:"success"`
+	Errors     []ErrorDetail   `json:"errors,omitempty"`
+	Messages   []any           `json:"messages,omitempty"`
+	ResultInfo *cfResultInfo   `json:"result_info,omitempty"`
 }
 
 type cfResultInfo struct {
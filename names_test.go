@@ -0,0 +1,19 @@
+package cloudflare
+
+import "testing"
+
+func TestNormalizeDomain(t *testing.T) {
+	for input, expected := range map[string]string{
+		"example.com":           "example.com",
+		"example.com.":          "example.com",
+		"Example.COM.":          "example.com",
+		"bücher.example":        "xn--bcher-kva.example",
+		"München.DE.":           "xn--mnchen-3ya.de",
+		"例え.テスト":                "xn--r8jz45g.xn--zckzah",
+		"xn--bcher-kva.example": "xn--bcher-kva.example",
+	} {
+		if actual := normalizeDomain(input); actual != expected {
+			t.Errorf("normalizeDomain(%q): expected %q, got %q", input, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package cloudflare
+
+import (
+	"fmt"
+
+	"github.com/libdns/libdns"
+)
+
+// protection returns why r can't or shouldn't be changed, or an empty
+// string if it can be.
+func (r cfDNSRecord) protection() string {
+	switch {
+	case r.Locked:
+		return "locked"
+	case r.Meta == nil:
+		return ""
+	case r.Meta.ReadOnly:
+		return "read-only"
+	case r.Meta.EmailRouting:
+		return "managed by Email Routing"
+	case r.Meta.AutoAdded:
+		return "added automatically by Cloudflare"
+	}
+	return ""
+}
+
+// protectedRecords applies the provider's policy for protected records
+// while planning changes to a zone.
+type protectedRecords struct {
+	policy string
+	zone   string
+	found  []ProtectedRecord
+}
+
+func (p *Provider) protectedRecords(zone string) (*protectedRecords, error) {
+	switch p.ProtectedRecords {
+	case "", "error", "skip", "allow":
+	default:
+		return nil, fmt.Errorf("unknown policy for protected records: %q", p.ProtectedRecords)
+	}
+	return &protectedRecords{policy: p.ProtectedRecords, zone: zone}, nil
+}
+
+// allow returns true if rec, which is protected for the given reason (if
+// not empty), may be changed. If it may not be and the policy is to refuse,
+// rec is remembered for the error.
+func (pr *protectedRecords) allow(rec cfDNSRecord, reason string) bool {
+	if reason == "" || pr.policy == "allow" {
+		return true
+	}
+	if pr.policy != "skip" {
+		protected := ProtectedRecord{Reason: reason}
+		protected.Record, _ = rec.libdnsRecord(pr.zone)
+		pr.found = append(pr.found, protected)
+	}
+	return false
+}
+
+// err returns the error for the protected records that would have been
+// changed, if any. (Since it is returned before making changes, it is an
+// [libdns.AtomicErr].)
+func (pr *protectedRecords) err() error {
+	if len(pr.found) == 0 {
+		return nil
+	}
+	return libdns.AtomicErr(&ProtectedRecordError{Records: pr.found})
+}
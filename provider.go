@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"sync"
+	"time"
 
 	"github.com/libdns/libdns"
 )
@@ -15,7 +15,6 @@ type HTTPClient interface {
 }
 
 // Provider implements the libdns interfaces for Cloudflare.
-// TODO: Support retries and handle rate limits.
 type Provider struct {
 	// API tokens are used for authentication. Make sure to use
 	// scoped API **tokens**, NOT a global API **key**.
@@ -26,46 +25,69 @@ type Provider struct {
 	// If nil, a default client will be used.
 	HTTPClient HTTPClient `json:"-"`
 
-	zones   map[string]cfZone
-	zonesMu sync.Mutex
+	// BaseURL is the base URL of the Cloudflare API, for example to go
+	// through a proxy or to use a local stand-in for testing. If empty,
+	// "https://api.cloudflare.com/client/v4" is used.
+	BaseURL string `json:"base_url,omitempty"`
+
+	// Retry configures how requests that fail with a transient error
+	// (rate limiting, 5xx responses, connection errors) are retried.
+	// If nil, a default policy of up to 3 attempts is used.
+	Retry *RetryPolicy `json:"retry,omitempty"`
+
+	// RateLimiter, if set, is waited on before every API request.
+	// It may be shared with other providers.
+	RateLimiter *RateLimiter `json:"-"`
+
+	// If true and RateLimiter is nil, requests are limited by a
+	// process-wide limiter shared by all providers using the same
+	// token, sized to Cloudflare's default request budget.
+	SharedRateLimit bool `json:"shared_rate_limit,omitempty"`
+
+	// If true, methods that change several records undo the changes they
+	// made if they fail partway through, to leave the zone as it was. (When
+	// all the changes fit in a single batch request, this is not necessary,
+	// since Cloudflare applies batches atomically.) If false, or if rolling
+	// back fails, the methods return the records that were changed along
+	// with a *PartialError.
+	Rollback bool `json:"rollback,omitempty"`
+
+	// The maximum number of pages of results fetched at once when
+	// listing records or zones. Default: 4. All requests still wait
+	// on the rate limiter, if any.
+	PageConcurrency int `json:"page_concurrency,omitempty"`
+
+	// What to do when SetRecords or DeleteRecords would change records
+	// that Cloudflare manages or doesn't allow changing (records that are
+	// locked, read-only, managed by Email Routing, or added automatically):
+	// "error" (the default) refuses to make any changes and returns a
+	// *ProtectedRecordError; "skip" leaves those records alone and makes
+	// the other changes (SetRecords and DeleteRecords don't return the
+	// skipped records); "allow" tries to change them anyway.
+	ProtectedRecords string `json:"protected_records,omitempty"`
+
+	// How long to cache zone info (such as zone IDs) for. If zero, it
+	// is cached for an hour; if negative, it is not cached. See also
+	// InvalidateZone and ClearCache.
+	ZoneCacheTTL time.Duration `json:"zone_cache_ttl,omitempty"`
+
+	zoneCache zoneCache
+
+	batchUnsupported int32 // set to 1 (atomically) if the batch endpoint is unavailable
 }
 
-// GetRecords lists all the records in the zone.
+// GetRecords lists all the records in the zone. After the first page of records,
+// the rest are fetched concurrently (see PageConcurrency).
 func (p *Provider) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
 	zoneInfo, err := p.getZoneInfo(ctx, zone)
 	if err != nil {
 		return nil, err
 	}
 
-	page := 1
 	const maxPageSize = 100
-
-	var allRecords []cfDNSRecord
-	for {
-		qs := make(url.Values)
-		qs.Set("page", fmt.Sprintf("%d", page))
-		qs.Set("per_page", fmt.Sprintf("%d", maxPageSize))
-		reqURL := fmt.Sprintf("%s/zones/%s/dns_records?%s", baseURL, zoneInfo.ID, qs.Encode())
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
-		if err != nil {
-			return nil, err
-		}
-
-		var pageRecords []cfDNSRecord
-		response, err := p.doAPIRequest(req, &pageRecords)
-		if err != nil {
-			return nil, err
-		}
-
-		allRecords = append(allRecords, pageRecords...)
-
-		lastPage := (response.ResultInfo.TotalCount + response.ResultInfo.PerPage - 1) / response.ResultInfo.PerPage
-		if response.ResultInfo == nil || page >= lastPage || len(pageRecords) == 0 {
-			break
-		}
-
-		page++
+	allRecords, err := getAllPages[cfDNSRecord](ctx, p, "/zones/"+zoneInfo.ID+"/dns_records", nil, maxPageSize)
+	if err != nil {
+		return nil, err
 	}
 
 	recs := make([]libdns.Record, 0, len(allRecords))
@@ -81,21 +103,39 @@ func (p *Provider) GetRecords(ctx context.Context, zone string) ([]libdns.Record
 }
 
 // AppendRecords adds records to the zone. It returns the records that were added.
+// If an identical record already exists in the zone (for example, because an
+// earlier attempt at the same change succeeded), it is returned instead of an
+// error, so appending the same records again is harmless. Records are created
+// with as few batch requests as possible; if all of them fit in a single batch
+// request, AppendRecords is atomic; otherwise, see the Rollback field.
 func (p *Provider) AppendRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
 	zoneInfo, err := p.getZoneInfo(ctx, zone)
 	if err != nil {
 		return nil, err
 	}
 
-	var created []libdns.Record
+	var batch cfBatch
 	for _, rec := range records {
-		result, err := p.createRecord(ctx, zoneInfo, rec)
+		cfRec, err := cloudflareRecord(rec)
 		if err != nil {
 			return nil, err
 		}
-		libdnsRec, err := result.libdnsRecord(zone)
+		batch.Posts = append(batch.Posts, cfRec)
+	}
+	batch.existing = func(ctx context.Context, cfRec cfDNSRecord) (cfDNSRecord, bool, error) {
+		return p.findIdentical(ctx, zoneInfo, cfRec)
+	}
+
+	result, err := p.applyBatch(ctx, zoneInfo.ID, batch)
+	if err != nil {
+		return partialResult(zone, batch, result, err)
+	}
+
+	created := make([]libdns.Record, 0, len(result.Posts))
+	for _, cfRec := range result.Posts {
+		libdnsRec, err := cfRec.libdnsRecord(zone)
 		if err != nil {
-			return nil, fmt.Errorf("parsing Cloudflare DNS record %+v: %v", rec, err)
+			return nil, fmt.Errorf("parsing Cloudflare DNS record %+v: %v", cfRec, err)
 		}
 		created = append(created, libdnsRec)
 	}
@@ -103,99 +143,190 @@ func (p *Provider) AppendRecords(ctx context.Context, zone string, records []lib
 	return created, nil
 }
 
-// DeleteRecords deletes the records from the zone. If a record does not have an ID,
-// it will be looked up. It returns the records that were deleted.
+// DeleteRecords deletes the records from the zone. If a record does not have an ID
+// in its ProviderData (records returned by this package do), it will be looked up;
+// as specified by libdns, an empty type or data, or a zero TTL, matches any value,
+// so all of the matching records are deleted. A record with an ID is deleted
+// only if the record with that ID still matches it, and records that don't
+// exist (anymore) are ignored.
+// It returns the records that were deleted. The deletions are made with as few
+// batch requests as possible; if all of them fit in a single batch request,
+// DeleteRecords is atomic; otherwise, see the Rollback field.
 func (p *Provider) DeleteRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
 	zoneInfo, err := p.getZoneInfo(ctx, zone)
 	if err != nil {
 		return nil, err
 	}
 
-	var recs []libdns.Record
+	protected, err := p.protectedRecords(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	var batch cfBatch
+	seen := make(map[string]bool)
+	byName := make(map[string][]cfDNSRecord) // records looked up by name
 	for _, rec := range records {
+		// if we know the record's ID, it is only a hint: the record is
+		// deleted if it still exists and matches, which is checked with one
+		// lookup of all the records with its name (shared by the others)
+		if data, ok := providerDataOf(rec); ok && data.ID != "" && (data.ZoneID == "" || data.ZoneID == zoneInfo.ID) {
+			rr := rec.RR()
+			name := normalizeDomain(libdns.AbsoluteName(rr.Name, zoneInfo.Name))
+			named, ok := byName[name]
+			if !ok {
+				named, err = p.getDNSRecords(ctx, zoneInfo, libdns.RR{Name: rr.Name}, false)
+				if err != nil {
+					return nil, err
+				}
+				byName[name] = named
+			}
+			for _, cfRec := range named {
+				if cfRec.ID != data.ID || seen[cfRec.ID] || !cfRec.matches(zoneInfo.Name, rr) {
+					continue
+				}
+				// (data.Protected may be out of date, so it isn't used)
+				if protected.allow(cfRec, cfRec.protection()) {
+					seen[cfRec.ID] = true
+					batch.Deletes = append(batch.Deletes, cfRec)
+				}
+			}
+			continue
+		}
+
 		// record ID is required; try to find it with what was provided
 		exactMatches, err := p.getDNSRecords(ctx, zoneInfo, rec, true)
 		if err != nil {
 			return nil, err
 		}
-
 		for _, cfRec := range exactMatches {
-			reqURL := fmt.Sprintf("%s/zones/%s/dns_records/%s", baseURL, zoneInfo.ID, cfRec.ID)
-			req, err := http.NewRequestWithContext(ctx, "DELETE", reqURL, nil)
-			if err != nil {
-				return nil, err
+			if !seen[cfRec.ID] && protected.allow(cfRec, cfRec.protection()) {
+				seen[cfRec.ID] = true
+				batch.Deletes = append(batch.Deletes, cfRec)
 			}
+		}
+	}
+	if err := protected.err(); err != nil {
+		return nil, err
+	}
 
-			var result cfDNSRecord
-			_, err = p.doAPIRequest(req, &result)
-			if err != nil {
-				return nil, err
-			}
+	if result, err := p.applyBatch(ctx, zoneInfo.ID, batch); err != nil {
+		return partialResult(zone, batch, result, err)
+	}
 
-			libdnsRec, err := result.libdnsRecord(zone)
-			if err != nil {
-				return nil, fmt.Errorf("parsing Cloudflare DNS record %+v: %v", rec, err)
-			}
-			recs = append(recs, libdnsRec)
+	recs := make([]libdns.Record, 0, len(batch.Deletes))
+	for _, cfRec := range batch.Deletes {
+		libdnsRec, err := cfRec.libdnsRecord(zone)
+		if err != nil {
+			return nil, fmt.Errorf("parsing Cloudflare DNS record %+v: %v", cfRec, err)
 		}
-
+		recs = append(recs, libdnsRec)
 	}
 
 	return recs, nil
 }
 
 // SetRecords sets the records in the zone, either by updating existing records
-// or creating new ones. It returns the updated records.
+// or creating new ones, so that for each (name, type) pair in the input, the
+// input records are the only records in the zone with that name and type.
+// Existing records with identical data are left alone (except to update their
+// TTL and Cloudflare-specific attributes; see [ProviderData]), other existing
+// records in the RRset are updated or deleted, and the rest of the input records
+// are created; input records with an ID in their ProviderData update the existing
+// record with that ID. It returns the records that were set, which don't include
+// protected records that were skipped (see the ProtectedRecords field).
+// The changes are made with as few batch requests as possible; if all of them
+// fit in a single batch request, SetRecords is atomic; otherwise, see the Rollback
+// field.
 func (p *Provider) SetRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
 	zoneInfo, err := p.getZoneInfo(ctx, zone)
 	if err != nil {
 		return nil, err
 	}
 
-	var results []libdns.Record
-	for _, rec := range records {
-		oldRec, err := cloudflareRecord(rec)
-		if err != nil {
-			return nil, err
-		}
-		oldRec.ZoneID = zoneInfo.ID
+	// the source of each resulting record, so that we can return
+	// them in the same order as the input
+	type source struct {
+		op    string // "patch", "post", "skip", or "" if unchanged
+		index int    // index of the operation in the batch
+		rec   cfDNSRecord
+	}
+	sources := make([]source, len(records))
+
+	protected, err := p.protectedRecords(zone)
+	if err != nil {
+		return nil, err
+	}
 
-		// the record might already exist, even if we don't know the ID yet
-		matches, err := p.getDNSRecords(ctx, zoneInfo, rec, false)
+	batch := cfBatch{previous: make(map[string]cfDNSRecord)}
+	for _, set := range groupRRsets(zone, records) {
+		existing, err := p.getDNSRecords(ctx, zoneInfo, set.records[0], false)
 		if err != nil {
 			return nil, err
 		}
-		if len(matches) == 0 {
-			// record doesn't exist; create it
-			result, err := p.createRecord(ctx, zoneInfo, rec)
+
+		matches := matchRRset(zone, set.records, existing)
+		kept := make([]bool, len(existing))
+		for i, rec := range set.records {
+			cfRec, err := cloudflareRecord(rec)
 			if err != nil {
 				return nil, err
 			}
-			libdnsRec, err := result.libdnsRecord(zone)
-			if err != nil {
-				return nil, fmt.Errorf("parsing Cloudflare DNS record %+v: %v", rec, err)
+
+			j := matches[i]
+			if j < 0 {
+				batch.Posts = append(batch.Posts, cfRec)
+				sources[set.indexes[i]] = source{op: "post", index: len(batch.Posts) - 1}
+				continue
 			}
-			results = append(results, libdnsRec)
-			continue
-		}
-		if len(matches) > 1 {
-			return nil, fmt.Errorf("unexpectedly found more than 1 record for %v", rec)
+
+			ex := existing[j]
+			kept[j] = true
+			exRec, err := ex.libdnsRecord(zone)
+			if err == nil && sameData(exRec.RR(), rec.RR()) &&
+				!cfRec.ttlDiffers(ex) && !cfRec.attributesDiffer(ex) {
+				sources[set.indexes[i]] = source{rec: ex}
+				continue
+			}
+			if !protected.allow(ex, ex.protection()) {
+				sources[set.indexes[i]] = source{op: "skip"}
+				continue
+			}
+			cfRec.ID = ex.ID
+			batch.previous[ex.ID] = ex
+			batch.Patches = append(batch.Patches, cfRec)
+			sources[set.indexes[i]] = source{op: "patch", index: len(batch.Patches) - 1}
 		}
-		// record does exist, fill in the ID so that we can update it
-		oldRec.ID = matches[0].ID
 
-		// record exists; update it
-		cfRec, err := cloudflareRecord(rec)
-		if err != nil {
-			return nil, err
+		for j, ex := range existing {
+			if !kept[j] && protected.allow(ex, ex.protection()) {
+				batch.Deletes = append(batch.Deletes, ex)
+			}
 		}
-		result, err := p.updateRecord(ctx, oldRec, cfRec)
-		if err != nil {
-			return nil, err
+	}
+	if err := protected.err(); err != nil {
+		return nil, err
+	}
+
+	result, err := p.applyBatch(ctx, zoneInfo.ID, batch)
+	if err != nil {
+		return partialResult(zone, batch, result, err)
+	}
+
+	results := make([]libdns.Record, 0, len(records))
+	for _, src := range sources {
+		cfRec := src.rec
+		switch src.op {
+		case "patch":
+			cfRec = result.Patches[src.index]
+		case "post":
+			cfRec = result.Posts[src.index]
+		case "skip":
+			continue
 		}
-		libdnsRec, err := result.libdnsRecord(zone)
+		libdnsRec, err := cfRec.libdnsRecord(zone)
 		if err != nil {
-			return nil, fmt.Errorf("parsing Cloudflare DNS record %+v: %v", rec, err)
+			return nil, fmt.Errorf("parsing Cloudflare DNS record %+v: %v", cfRec, err)
 		}
 		results = append(results, libdnsRec)
 	}
@@ -205,23 +336,42 @@ func (p *Provider) SetRecords(ctx context.Context, zone string, records []libdns
 
 // ListZones lists all the zones in the account.
 func (p *Provider) ListZones(ctx context.Context) ([]libdns.Zone, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/zones", nil)
+	details, err := p.ListZoneDetails(ctx, ZoneFilter{})
 	if err != nil {
 		return nil, err
 	}
 
-	var cfZones []cfZone
-	_, err = p.doAPIRequest(req, &cfZones)
+	zones := make([]libdns.Zone, len(details))
+	for i, zone := range details {
+		zones[i] = libdns.Zone{Name: zone.Name}
+	}
+
+	return zones, nil
+}
+
+// ListZoneDetails lists the zones accessible to the API token that match
+// the filter, with details about each zone.
+func (p *Provider) ListZoneDetails(ctx context.Context, filter ZoneFilter) ([]ZoneDetails, error) {
+	qs := make(url.Values)
+	if filter.AccountID != "" {
+		qs.Set("account.id", filter.AccountID)
+	}
+	if filter.Status != "" {
+		qs.Set("status", filter.Status)
+	}
+	if filter.Type != "" {
+		qs.Set("type", filter.Type)
+	}
+
+	const maxPageSize = 50
+	cfZones, err := getAllPages[cfZone](ctx, p, "/zones", qs, maxPageSize)
 	if err != nil {
 		return nil, err
 	}
 
-	zones := make([]libdns.Zone, len(cfZones))
+	zones := make([]ZoneDetails, len(cfZones))
 	for i, cfZone := range cfZones {
-		zones[i] = libdns.Zone{
-			// Add trailing dot to make it a FQDN
-			Name: cfZone.Name + ".",
-		}
+		zones[i] = cfZone.details()
 	}
 
 	return zones, nil
@@ -0,0 +1,1183 @@
+package cloudflare_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/cloudflare"
+	"github.com/libdns/cloudflare/cloudflaretest"
+	"github.com/libdns/libdns"
+)
+
+const testZone = "example.com."
+
+// newTestProvider returns a provider backed by a fake Cloudflare API
+// with a single, empty zone named testZone.
+func newTestProvider(t *testing.T) (*cloudflare.Provider, *cloudflaretest.Server) {
+	t.Helper()
+	srv := cloudflaretest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.Token = "test-token"
+	srv.AddZone(testZone)
+	return &cloudflare.Provider{
+		APIToken: "test-token",
+		BaseURL:  srv.URL,
+	}, srv
+}
+
+func TestRecordLifecycle(t *testing.T) {
+	p, _ := newTestProvider(t)
+	ctx := context.Background()
+
+	added, err := p.AppendRecords(ctx, testZone, []libdns.Record{
+		libdns.Address{Name: "www", IP: netip.MustParseAddr("192.0.2.1")},
+		libdns.TXT{Name: "_acme-challenge", Text: "token-value"},
+		libdns.MX{Name: "@", Preference: 10, Target: "mail.example.com."},
+	})
+	if err != nil {
+		t.Fatalf("appending records: %v", err)
+	}
+	if len(added) != 3 {
+		t.Fatalf("expected 3 records to be added, got %d: %+v", len(added), added)
+	}
+	if txt, ok := added[1].(libdns.TXT); !ok || txt.Text != "token-value" {
+		t.Errorf("expected TXT record with unquoted text, got %#v", added[1])
+	}
+	if mx, ok := added[2].(libdns.MX); !ok || mx.Target != "mail.example.com." || mx.Preference != 10 || mx.Name != "@" {
+		t.Errorf("expected MX record at apex with trailing dot, got %#v", added[2])
+	}
+
+	_, err = p.SetRecords(ctx, testZone, []libdns.Record{
+		libdns.Address{Name: "www", IP: netip.MustParseAddr("192.0.2.2")},
+	})
+	if err != nil {
+		t.Fatalf("setting records: %v", err)
+	}
+
+	recs, err := p.GetRecords(ctx, testZone)
+	if err != nil {
+		t.Fatalf("getting records: %v", err)
+	}
+	if len(recs) != 3 {
+		t.Fatalf("expected 3 records in zone, got %d: %+v", len(recs), recs)
+	}
+	if addr, ok := recs[0].(libdns.Address); !ok || addr.IP.String() != "192.0.2.2" {
+		t.Errorf("expected updated address record, got %#v", recs[0])
+	}
+
+	deleted, err := p.DeleteRecords(ctx, testZone, []libdns.Record{
+		libdns.TXT{Name: "_acme-challenge", Text: "token-value"},
+	})
+	if err != nil {
+		t.Fatalf("deleting records: %v", err)
+	}
+	if len(deleted) != 1 {
+		t.Errorf("expected 1 deleted record, got %d: %+v", len(deleted), deleted)
+	}
+
+	zones, err := p.ListZones(ctx)
+	if err != nil {
+		t.Fatalf("listing zones: %v", err)
+	}
+	if len(zones) != 1 || zones[0].Name != testZone {
+		t.Errorf("expected only %s, got %+v", testZone, zones)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	p, _ := newTestProvider(t)
+	p.APIToken = "wrong-token"
+
+	_, err := p.GetRecords(context.Background(), testZone)
+	if !errors.Is(err, cloudflare.ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %v", err)
+	}
+	var apiErr *cloudflare.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected *APIError, got %T", err)
+	}
+	if apiErr.StatusCode != 403 || !apiErr.HasCode(10000) || apiErr.Method != "GET" || apiErr.Path != "/zones" || apiErr.RayID == "" {
+		t.Errorf("unexpected error details: %+v", apiErr)
+	}
+	if errors.Is(err, cloudflare.ErrZoneNotFound) {
+		t.Errorf("authentication error should not match ErrZoneNotFound")
+	}
+
+	// an invalid identifier means the zone was not found only if the
+	// zone ID is the only identifier in the request
+	for path, zoneNotFound := range map[string]bool{
+		"/client/v4/zones/abc":                   true,
+		"/client/v4/zones/abc/dns_records":       true,
+		"/client/v4/zones/abc/dns_records/batch": true,
+		"/client/v4/zones/abc/dns_records/def":   false,
+	} {
+		err := &cloudflare.APIError{
+			StatusCode: 404,
+			Path:       path,
+			Errors:     []cloudflare.ErrorDetail{{Code: 7003, Message: "Could not route to " + path}},
+		}
+		if errors.Is(err, cloudflare.ErrZoneNotFound) != zoneNotFound {
+			t.Errorf("expected error for %s to match ErrZoneNotFound: %t", path, zoneNotFound)
+		}
+	}
+}
+
+func TestBatching(t *testing.T) {
+	for _, disableBatch := range []bool{false, true} {
+		p, srv := newTestProvider(t)
+		srv.DisableBatch = disableBatch
+
+		var recs []libdns.Record
+		for i := 0; i < 3; i++ {
+			recs = append(recs, libdns.TXT{Name: "batch", Text: fmt.Sprintf("value %d", i)})
+		}
+		added, err := p.AppendRecords(context.Background(), testZone, recs)
+		if err != nil {
+			t.Fatalf("appending records (batch disabled: %t): %v", disableBatch, err)
+		}
+		if len(added) != 3 || len(srv.Records(testZone)) != 3 {
+			t.Errorf("expected 3 records to be added (batch disabled: %t), got %d", disableBatch, len(added))
+		}
+
+		var posts int
+		for _, req := range srv.Requests() {
+			if strings.HasPrefix(req, "POST ") {
+				posts++
+			}
+		}
+		if expected := map[bool]int{false: 1, true: 4}[disableBatch]; posts != expected {
+			t.Errorf("expected %d POST requests (batch disabled: %t), got %d: %v", expected, disableBatch, posts, srv.Requests())
+		}
+	}
+}
+
+func TestBatchNotReplayed(t *testing.T) {
+	p, srv := newTestProvider(t)
+	ctx := context.Background()
+
+	added, err := p.AppendRecords(ctx, testZone, []libdns.Record{
+		libdns.TXT{Name: "keep", Text: "value"},
+		libdns.TXT{Name: "stale", Text: "value"},
+	})
+	if err != nil {
+		t.Fatalf("appending records: %v", err)
+	}
+	zoneID := srv.Records(testZone)[0].ZoneID
+	batchPath := "POST /zones/" + zoneID + "/dns_records/batch"
+	staleID := added[1].(libdns.TXT).ProviderData.(cloudflare.ProviderData).ID
+
+	// the record is deleted by someone else just before the batch is sent,
+	// so the batch itself fails with a 404
+	p.HTTPClient = hookClient(func(req *http.Request) {
+		if req.Method+" "+strings.TrimPrefix(req.URL.Path, "/client/v4") == batchPath {
+			srv.RemoveRecord(testZone, staleID)
+		}
+	})
+	batches := countRequests(srv, batchPath)
+	requests := len(srv.Requests())
+
+	// which must not be mistaken for a missing batch endpoint and
+	// replayed one at a time
+	_, err = p.DeleteRecords(ctx, testZone, added)
+	var apiErr *cloudflare.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || !apiErr.HasCode(81044) {
+		t.Fatalf("expected the batch to fail with record not found, got %v", err)
+	}
+	if countRequests(srv, batchPath) != batches+1 {
+		t.Fatalf("expected the deletions to be sent in a batch, got %v", srv.Requests()[requests:])
+	}
+	if n := len(srv.Records(testZone)); n != 1 {
+		t.Errorf("expected the other record to be kept, got %d records", n)
+	}
+	for _, req := range srv.Requests()[requests:] {
+		if strings.HasPrefix(req, "DELETE ") {
+			t.Errorf("expected no individual deletes, got %s", req)
+		}
+	}
+
+	// and the batch endpoint is still used
+	batches = countRequests(srv, batchPath)
+	if _, err := p.AppendRecords(ctx, testZone, []libdns.Record{libdns.TXT{Name: "new", Text: "value"}}); err != nil {
+		t.Fatalf("appending record: %v", err)
+	}
+	if countRequests(srv, batchPath) != batches+1 {
+		t.Errorf("expected the batch endpoint to be used")
+	}
+}
+
+// hookClient is an HTTP client that calls itself with each request
+// before sending it.
+type hookClient func(*http.Request)
+
+func (hook hookClient) Do(req *http.Request) (*http.Response, error) {
+	hook(req)
+	return http.DefaultClient.Do(req)
+}
+
+func TestSetRecordsRRset(t *testing.T) {
+	p, srv := newTestProvider(t)
+	ctx := context.Background()
+
+	_, err := p.AppendRecords(ctx, testZone, []libdns.Record{
+		libdns.Address{Name: "alpha", IP: netip.MustParseAddr("2001:db8::1")},
+		libdns.Address{Name: "alpha", IP: netip.MustParseAddr("2001:db8::2")},
+		libdns.Address{Name: "alpha", IP: netip.MustParseAddr("2001:db8::9")},
+		libdns.Address{Name: "beta", IP: netip.MustParseAddr("2001:db8::3")},
+		libdns.TXT{Name: "alpha", Text: "unrelated"},
+	})
+	if err != nil {
+		t.Fatalf("appending records: %v", err)
+	}
+
+	set, err := p.SetRecords(ctx, testZone, []libdns.Record{
+		libdns.Address{Name: "alpha", IP: netip.MustParseAddr("2001:db8::1")},
+		libdns.Address{Name: "alpha", IP: netip.MustParseAddr("2001:db8::5")},
+		libdns.Address{Name: "alpha", IP: netip.MustParseAddr("2001:db8::6")},
+		libdns.Address{Name: "beta", IP: netip.MustParseAddr("2001:db8::4")},
+	})
+	if err != nil {
+		t.Fatalf("setting records: %v", err)
+	}
+	if len(set) != 4 {
+		t.Fatalf("expected 4 records to be set, got %d: %+v", len(set), set)
+	}
+	if addr := set[2].(libdns.Address); addr.Name != "alpha" || addr.IP.String() != "2001:db8::6" {
+		t.Errorf("expected results in input order, got %+v", set)
+	}
+
+	got := make(map[string]bool)
+	for _, rec := range srv.Records(testZone) {
+		got[rec.Name+" "+rec.Type+" "+rec.Content] = true
+	}
+	expected := []string{
+		"alpha.example.com AAAA 2001:db8::1",
+		"alpha.example.com AAAA 2001:db8::5",
+		"alpha.example.com AAAA 2001:db8::6",
+		"beta.example.com AAAA 2001:db8::4",
+		"alpha.example.com TXT \"unrelated\"",
+	}
+	for _, want := range expected {
+		if !got[want] {
+			t.Errorf("expected zone to contain %s", want)
+		}
+	}
+	if len(got) != len(expected) {
+		t.Errorf("expected %d records in zone, got %d: %v", len(expected), len(got), got)
+	}
+}
+
+func TestPartialFailure(t *testing.T) {
+	for _, rollback := range []bool{false, true} {
+		p, srv := newTestProvider(t)
+		p.Rollback = rollback
+		srv.DisableBatch = true // the batch endpoint would make the call atomic anyway
+		if _, err := srv.AddRecord(testZone, cloudflaretest.Record{Type: "A", Name: "conflict", Content: "192.0.2.1", TTL: 1}); err != nil {
+			t.Fatal(err)
+		}
+
+		recs, err := p.AppendRecords(context.Background(), testZone, []libdns.Record{
+			libdns.TXT{Name: "partial", Text: "one"},
+			libdns.TXT{Name: "partial", Text: "two"},
+			libdns.CNAME{Name: "conflict", Target: "example.net."},
+		})
+		if err == nil {
+			t.Fatalf("expected error (rollback: %t)", rollback)
+		}
+
+		var partialErr *cloudflare.PartialError
+		if rollback {
+			if errors.As(err, &partialErr) || len(recs) != 0 {
+				t.Errorf("expected changes to be rolled back, got %v and %+v", err, recs)
+			}
+			if n := len(srv.Records(testZone)); n != 1 {
+				t.Errorf("expected only the original record to remain, got %d records", n)
+			}
+		} else {
+			if !errors.As(err, &partialErr) {
+				t.Fatalf("expected *PartialError, got %T: %v", err, err)
+			}
+			if len(recs) != 2 || len(partialErr.Applied) != 2 {
+				t.Errorf("expected 2 applied records, got %+v and %+v", recs, partialErr.Applied)
+			}
+			if n := len(srv.Records(testZone)); n != 3 {
+				t.Errorf("expected 3 records in zone, got %d", n)
+			}
+		}
+	}
+}
+
+func TestProviderData(t *testing.T) {
+	p, srv := newTestProvider(t)
+	ctx := context.Background()
+
+	added, err := p.AppendRecords(ctx, testZone, []libdns.Record{
+		libdns.Address{
+			Name: "proxied",
+			IP:   netip.MustParseAddr("192.0.2.1"),
+			ProviderData: cloudflare.ProviderData{
+				Proxied: true,
+				Comment: "web server",
+				Tags:    []string{"env:prod"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("appending records: %v", err)
+	}
+	data, ok := added[0].(libdns.Address).ProviderData.(cloudflare.ProviderData)
+	if !ok || !data.Proxied || data.Comment != "web server" || len(data.Tags) != 1 || data.Tags[0] != "env:prod" {
+		t.Fatalf("expected attributes to round-trip, got %#v", added[0])
+	}
+
+	// updating the address without ProviderData must not change the attributes
+	_, err = p.SetRecords(ctx, testZone, []libdns.Record{
+		libdns.Address{Name: "proxied", IP: netip.MustParseAddr("192.0.2.2")},
+	})
+	if err != nil {
+		t.Fatalf("setting records: %v", err)
+	}
+	rec := srv.Records(testZone)[0]
+	if !rec.Proxied || rec.Comment == nil || *rec.Comment != "web server" || rec.Content != "192.0.2.2" {
+		t.Errorf("expected record to stay proxied with its comment, got %+v", rec)
+	}
+
+	// updating only the attributes must be noticed
+	_, err = p.SetRecords(ctx, testZone, []libdns.Record{
+		libdns.Address{Name: "proxied", IP: netip.MustParseAddr("192.0.2.2"), ProviderData: &cloudflare.ProviderData{}},
+	})
+	if err != nil {
+		t.Fatalf("setting records: %v", err)
+	}
+	rec = srv.Records(testZone)[0]
+	if rec.Proxied || (rec.Comment != nil && *rec.Comment != "") || len(rec.Tags) != 0 {
+		t.Errorf("expected attributes to be cleared, got %+v", rec)
+	}
+}
+
+func TestRecordIDs(t *testing.T) {
+	p, srv := newTestProvider(t)
+	ctx := context.Background()
+
+	_, err := p.AppendRecords(ctx, testZone, []libdns.Record{
+		libdns.Address{Name: "www", TTL: 5 * time.Minute, IP: netip.MustParseAddr("192.0.2.1")},
+		libdns.Address{Name: "www", TTL: 5 * time.Minute, IP: netip.MustParseAddr("192.0.2.2")},
+	})
+	if err != nil {
+		t.Fatalf("appending records: %v", err)
+	}
+	recs, err := p.GetRecords(ctx, testZone)
+	if err != nil {
+		t.Fatalf("getting records: %v", err)
+	}
+	zoneID := srv.Records(testZone)[0].ZoneID
+	listPath := "GET /zones/" + zoneID + "/dns_records"
+	lookups := countRequests(srv, listPath)
+
+	// records returned by GetRecords carry their IDs, so changing one of
+	// them doesn't require finding it first
+	rec := recs[0].(libdns.Address)
+	data := rec.ProviderData.(cloudflare.ProviderData)
+	if data.ID == "" || data.ZoneID != zoneID {
+		t.Fatalf("expected record and zone IDs in ProviderData, got %#v", data)
+	}
+	rec.IP = netip.MustParseAddr("192.0.2.3")
+	_, err = p.SetRecords(ctx, testZone, []libdns.Record{rec, recs[1]})
+	if err != nil {
+		t.Fatalf("setting records: %v", err)
+	}
+	for _, r := range srv.Records(testZone) {
+		if r.ID == data.ID && r.Content != "192.0.2.3" {
+			t.Errorf("expected record %s to be updated in place, got %+v", data.ID, r)
+		}
+	}
+
+	before := len(srv.Requests())
+	deleted, err := p.DeleteRecords(ctx, testZone, []libdns.Record{recs[1]})
+	if err != nil {
+		t.Fatalf("deleting records: %v", err)
+	}
+	// one lookup to make sure the record is still the same (which also says
+	// whether it's protected), and one batch request
+	expected := []string{listPath, "POST /zones/" + zoneID + "/dns_records/batch"}
+	if reqs := srv.Requests()[before:]; !reflect.DeepEqual(reqs, expected) {
+		t.Errorf("expected requests %v to delete the record, got %v", expected, reqs)
+	}
+	if len(deleted) != 1 || deleted[0].RR().Data != "192.0.2.2" {
+		t.Errorf("expected the second address to be deleted, got %v", deleted)
+	}
+	remaining := srv.Records(testZone)
+	if len(remaining) != 1 || remaining[0].ID != data.ID {
+		t.Errorf("expected only record %s to remain, got %+v", data.ID, remaining)
+	}
+	if n := countRequests(srv, listPath) - lookups; n != 2 {
+		t.Errorf("expected SetRecords and DeleteRecords to list the name once each, got %d lookups", n)
+	}
+}
+
+func TestDeleteRecordsByID(t *testing.T) {
+	p, srv := newTestProvider(t)
+	ctx := context.Background()
+
+	added, err := p.AppendRecords(ctx, testZone, []libdns.Record{
+		libdns.Address{Name: "www", TTL: 5 * time.Minute, IP: netip.MustParseAddr("192.0.2.1")},
+	})
+	if err != nil {
+		t.Fatalf("appending records: %v", err)
+	}
+	changed := added[0].(libdns.Address)
+	changed.IP = netip.MustParseAddr("192.0.2.9")
+	set, err := p.SetRecords(ctx, testZone, []libdns.Record{changed})
+	if err != nil {
+		t.Fatalf("setting records: %v", err)
+	}
+
+	// the ID is only a hint: a record that was changed since doesn't match
+	deleted, err := p.DeleteRecords(ctx, testZone, added)
+	if err != nil {
+		t.Fatalf("deleting records: %v", err)
+	}
+	if len(deleted) != 0 || len(srv.Records(testZone)) != 1 {
+		t.Errorf("expected the changed record to be kept, got %v deleted", deleted)
+	}
+
+	// and deleting a record again is not an error
+	for i := 0; i < 2; i++ {
+		deleted, err = p.DeleteRecords(ctx, testZone, set)
+		if err != nil {
+			t.Fatalf("deleting records (attempt %d): %v", i+1, err)
+		}
+		if expected := 1 - i; len(deleted) != expected {
+			t.Errorf("expected %d deleted records (attempt %d), got %v", expected, i+1, deleted)
+		}
+	}
+	if n := len(srv.Records(testZone)); n != 0 {
+		t.Errorf("expected no records, got %d", n)
+	}
+}
+
+func TestDeleteRecordsWildcards(t *testing.T) {
+	p, srv := newTestProvider(t)
+	ctx := context.Background()
+
+	_, err := p.AppendRecords(ctx, testZone, []libdns.Record{
+		libdns.Address{Name: "foo", TTL: 5 * time.Minute, IP: netip.MustParseAddr("192.0.2.1")},
+		libdns.Address{Name: "foo", TTL: 10 * time.Minute, IP: netip.MustParseAddr("192.0.2.2")},
+		libdns.TXT{Name: "foo", TTL: 5 * time.Minute, Text: "hello"},
+		libdns.MX{Name: "foo", TTL: 5 * time.Minute, Preference: 10, Target: "mail.example.com."},
+		libdns.SRV{Service: "sip", Transport: "tcp", Name: "foo", TTL: 5 * time.Minute, Priority: 1, Weight: 2, Port: 5060, Target: "sip.example.com."},
+		libdns.Address{Name: "bar", TTL: 5 * time.Minute, IP: netip.MustParseAddr("192.0.2.1")},
+	})
+	if err != nil {
+		t.Fatalf("appending records: %v", err)
+	}
+
+	for _, tc := range []struct {
+		del  libdns.Record
+		want int
+	}{
+		{del: libdns.RR{Name: "foo", Type: "A", TTL: 15 * time.Minute}, want: 0},
+		{del: libdns.RR{Name: "foo", Type: "A", TTL: 10 * time.Minute}, want: 1},
+		{del: libdns.RR{Name: "foo", Type: "MX", Data: "10 mail.example.com."}, want: 1},
+		{del: libdns.RR{Name: "_sip._tcp.foo", Type: "SRV", Data: "1 2 5061 sip.example.com."}, want: 0},
+		{del: libdns.RR{Name: "_sip._tcp.foo", Type: "SRV", Data: "1 2 5060 sip.example.com."}, want: 1},
+		{del: libdns.RR{Name: "foo", Data: "192.0.2.1"}, want: 1},
+		{del: libdns.RR{Name: "foo"}, want: 1},
+	} {
+		deleted, err := p.DeleteRecords(ctx, testZone, []libdns.Record{tc.del})
+		if err != nil {
+			t.Fatalf("deleting %+v: %v", tc.del, err)
+		}
+		if len(deleted) != tc.want {
+			t.Errorf("deleting %+v: expected %d deleted records, got %d: %v", tc.del, tc.want, len(deleted), deleted)
+		}
+	}
+
+	remaining := srv.Records(testZone)
+	if len(remaining) != 1 || remaining[0].Name != "bar.example.com" {
+		t.Errorf("expected only bar to remain, got %+v", remaining)
+	}
+}
+
+func TestAppendRecordsIdempotent(t *testing.T) {
+	for _, disableBatch := range []bool{false, true} {
+		p, srv := newTestProvider(t)
+		srv.DisableBatch = disableBatch
+		ctx := context.Background()
+
+		challenge := libdns.TXT{Name: "_acme-challenge", TTL: 2 * time.Minute, Text: "token-value"}
+		first, err := p.AppendRecords(ctx, testZone, []libdns.Record{challenge})
+		if err != nil {
+			t.Fatalf("appending records: %v", err)
+		}
+
+		// retrying the same change, plus another record, must succeed
+		postPath := "POST /zones/" + srv.Records(testZone)[0].ZoneID + "/dns_records"
+		posts := countRequests(srv, postPath)
+		again, err := p.AppendRecords(ctx, testZone, []libdns.Record{
+			challenge,
+			libdns.TXT{Name: "_acme-challenge", TTL: 2 * time.Minute, Text: "other-token"},
+		})
+		if err != nil {
+			t.Fatalf("appending records again (batch disabled: %t): %v", disableBatch, err)
+		}
+		if len(again) != 2 {
+			t.Fatalf("expected 2 records, got %v", again)
+		}
+		firstID := first[0].(libdns.TXT).ProviderData.(cloudflare.ProviderData).ID
+		if id := again[0].(libdns.TXT).ProviderData.(cloudflare.ProviderData).ID; id != firstID {
+			t.Errorf("expected the existing record %s to be returned, got %s", firstID, id)
+		}
+		if n := len(srv.Records(testZone)); n != 2 {
+			t.Errorf("expected 2 records in the zone, got %d", n)
+		}
+		// with the batch endpoint, the new record is still created atomically
+		if n := countRequests(srv, postPath) - posts; !disableBatch && n != 0 {
+			t.Errorf("expected no records to be created one at a time, got %d", n)
+		}
+	}
+}
+
+func TestStructuredData(t *testing.T) {
+	p, srv := newTestProvider(t)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		rr   libdns.RR
+		want string // if different from the input
+	}{
+		{rr: libdns.RR{Type: "LOC", Data: "51 30 12.748 N 0 7 39.611 W 0m"}, want: "51 30 12.748 N 0 7 39.611 W 0m 1m 10000m 10m"},
+		{rr: libdns.RR{Type: "LOC", Data: "37 46 46 N 122 23 35 W 0m 100m 0m 0m"}},
+		{rr: libdns.RR{Type: "SSHFP", Data: "4 2 123456789ABCDEF67890123456789ABCDEF67890123456789ABCDEF123456789A"}, want: "4 2 123456789abcdef67890123456789abcdef67890123456789abcdef123456789a"},
+		{rr: libdns.RR{Name: "_443._tcp", Type: "TLSA", Data: "3 1 1 0c72ac70b745ac19998811b131d662c9ac69dbdbe7cb23e5b514b56664c5d3d6"}},
+		{rr: libdns.RR{Type: "SMIMEA", Data: "0 0 0 d2abde240d7cd3ee6b4b28c54df034b9 7983a1d16e8a410e4561cb106618e971"}, want: "0 0 0 d2abde240d7cd3ee6b4b28c54df034b97983a1d16e8a410e4561cb106618e971"},
+		{rr: libdns.RR{Type: "CERT", Data: "1 12345 8 MIIBIjANBgkqhkiG9w0BAQEF"}},
+		{rr: libdns.RR{Type: "DNSKEY", Data: "257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ=="}},
+		{rr: libdns.RR{Type: "DS", Data: "2371 13 2 1F987CC6583E92DF0890718C42"}, want: "2371 13 2 1f987cc6583e92df0890718c42"},
+		{rr: libdns.RR{Type: "NAPTR", Data: `100 10 "U" "E2U+sip" "!^.*$!sip:info@example.com!" .`}},
+		{rr: libdns.RR{Name: "_ftp._tcp", Type: "URI", Data: `10 1 "ftp://ftp1.example.com/public"`}},
+	} {
+		if tc.rr.Name == "" {
+			tc.rr.Name = "data"
+		}
+		tc.rr.TTL = time.Hour
+		if tc.want == "" {
+			tc.want = tc.rr.Data
+		}
+
+		added, err := p.AppendRecords(ctx, testZone, []libdns.Record{tc.rr})
+		if err != nil {
+			t.Errorf("appending %s record: %v", tc.rr.Type, err)
+			continue
+		}
+		if got := added[0].RR().Data; got != tc.want {
+			t.Errorf("expected %s record data %q, got %q", tc.rr.Type, tc.want, got)
+		}
+
+		// the input form must be recognized as the same data
+		batchPath := "POST /zones/" + srv.Records(testZone)[0].ZoneID + "/dns_records/batch"
+		batches := countRequests(srv, batchPath)
+		if _, err := p.SetRecords(ctx, testZone, []libdns.Record{tc.rr}); err != nil {
+			t.Errorf("setting %s record: %v", tc.rr.Type, err)
+			continue
+		}
+		if countRequests(srv, batchPath) != batches {
+			t.Errorf("expected setting the same %s record to change nothing", tc.rr.Type)
+		}
+		deleted, err := p.DeleteRecords(ctx, testZone, []libdns.Record{tc.rr})
+		if err != nil || len(deleted) != 1 {
+			t.Errorf("deleting %s record: expected 1 deleted record, got %v (err=%v)", tc.rr.Type, deleted, err)
+		}
+	}
+}
+
+func TestLongTXT(t *testing.T) {
+	p, srv := newTestProvider(t)
+	ctx := context.Background()
+
+	dkim := "v=DKIM1; k=rsa; p=" + strings.Repeat("MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA", 12)
+	added, err := p.AppendRecords(ctx, testZone, []libdns.Record{
+		libdns.TXT{Name: "mail._domainkey", TTL: time.Hour, Text: dkim},
+	})
+	if err != nil {
+		t.Fatalf("appending records: %v", err)
+	}
+	if text := added[0].(libdns.TXT).Text; text != dkim {
+		t.Errorf("expected text to be reassembled, got %q", text)
+	}
+	if content := srv.Records(testZone)[0].Content; strings.Count(content, `" "`) != 2 {
+		t.Errorf("expected content to be split into 3 strings, got %s", content)
+	}
+
+	// text split differently by someone else is still the same text
+	if _, err := srv.AddRecord(testZone, cloudflaretest.Record{
+		Type:    "TXT",
+		Name:    "split",
+		TTL:     3600,
+		Content: `"` + dkim[:100] + `" "` + dkim[100:] + `"`,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	set, err := p.SetRecords(ctx, testZone, []libdns.Record{
+		libdns.TXT{Name: "split", TTL: time.Hour, Text: dkim},
+	})
+	if err != nil {
+		t.Fatalf("setting records: %v", err)
+	}
+	if text := set[0].(libdns.TXT).Text; text != dkim {
+		t.Errorf("expected text to be reassembled, got %q", text)
+	}
+
+	deleted, err := p.DeleteRecords(ctx, testZone, []libdns.Record{
+		libdns.TXT{Name: "mail._domainkey", Text: dkim},
+		libdns.TXT{Name: "split", Text: dkim},
+	})
+	if err != nil {
+		t.Fatalf("deleting records: %v", err)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("expected 2 deleted records, got %v", deleted)
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	p, srv := newTestProvider(t)
+	ctx := context.Background()
+
+	text := "say \"hi\" \\ caf\u00e9\ttab"
+	added, err := p.AppendRecords(ctx, testZone, []libdns.Record{
+		libdns.TXT{Name: "txt", TTL: time.Hour, Text: text},
+		libdns.RR{Name: "caa", TTL: time.Hour, Type: "CAA", Data: `0 iodef "mailto:security@example.com?subject=CAA \"report\""`},
+	})
+	if err != nil {
+		t.Fatalf("appending records: %v", err)
+	}
+	if got := added[0].(libdns.TXT).Text; got != text {
+		t.Errorf("expected TXT text %q, got %q", text, got)
+	}
+	if got := added[1].(libdns.CAA).Value; got != `mailto:security@example.com?subject=CAA "report"` {
+		t.Errorf("expected CAA value to be unescaped, got %q", got)
+	}
+	for _, rec := range srv.Records(testZone) {
+		if want := `"say \"hi\" \\ caf\195\169\009tab"`; rec.Type == "TXT" && rec.Content != want {
+			t.Errorf("expected TXT content %s, got %s", want, rec.Content)
+		}
+	}
+
+	// the same records must be recognized in both forms
+	deleted, err := p.DeleteRecords(ctx, testZone, []libdns.Record{
+		libdns.TXT{Name: "txt", Text: text},
+		libdns.CAA{Name: "caa", Tag: "iodef", Value: `mailto:security@example.com?subject=CAA "report"`},
+	})
+	if err != nil {
+		t.Fatalf("deleting records: %v", err)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("expected 2 deleted records, got %v", deleted)
+	}
+
+	// quotes at either end of the text are part of the text too
+	for _, tc := range []struct{ text, content string }{
+		{text: `"quoted"`, content: `"\"quoted\""`},
+		{text: `say "hi"`, content: `"say \"hi\""`},
+		{text: `"hi" there`, content: `"\"hi\" there"`},
+		{text: `"`, content: `"\""`},
+	} {
+		added, err := p.AppendRecords(ctx, testZone, []libdns.Record{
+			libdns.TXT{Name: "quotes", TTL: time.Hour, Text: tc.text},
+		})
+		if err != nil {
+			t.Fatalf("appending %q: %v", tc.text, err)
+		}
+		if got := added[0].(libdns.TXT).Text; got != tc.text {
+			t.Errorf("expected TXT text %q, got %q", tc.text, got)
+		}
+		for _, rec := range srv.Records(testZone) {
+			if rec.Name == "quotes.example.com" && rec.Content != tc.content {
+				t.Errorf("expected TXT content %s, got %s", tc.content, rec.Content)
+			}
+		}
+		recs, err := p.GetRecords(ctx, testZone)
+		if err != nil {
+			t.Fatalf("getting records: %v", err)
+		}
+		for _, rec := range recs {
+			if txt, ok := rec.(libdns.TXT); ok && txt.Name == "quotes" && txt.Text != tc.text {
+				t.Errorf("expected TXT text %q to read back unchanged, got %q", tc.text, txt.Text)
+			}
+		}
+		if _, err := p.DeleteRecords(ctx, testZone, []libdns.Record{libdns.TXT{Name: "quotes", Text: tc.text}}); err != nil {
+			t.Fatalf("deleting %q: %v", tc.text, err)
+		}
+		if n := len(srv.Records(testZone)); n != 0 {
+			t.Errorf("expected the %q record to be deleted, got %d records", tc.text, n)
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	p, srv := newTestProvider(t)
+	ctx := context.Background()
+
+	proxied := libdns.Address{
+		Name:         "proxied",
+		TTL:          5 * time.Minute,
+		IP:           netip.MustParseAddr("192.0.2.1"),
+		ProviderData: cloudflare.ProviderData{Proxied: true},
+	}
+	added, err := p.AppendRecords(ctx, testZone, []libdns.Record{
+		libdns.Address{Name: "auto", IP: netip.MustParseAddr("192.0.2.1")},
+		libdns.Address{Name: "short", TTL: 30 * time.Second, IP: netip.MustParseAddr("192.0.2.1")},
+		libdns.Address{Name: "long", TTL: 72 * time.Hour, IP: netip.MustParseAddr("192.0.2.1")},
+		libdns.Address{Name: "fractional", TTL: 299600 * time.Millisecond, IP: netip.MustParseAddr("192.0.2.1")},
+		proxied,
+	})
+	if err != nil {
+		t.Fatalf("appending records: %v", err)
+	}
+	for i, want := range []time.Duration{0, time.Minute, 24 * time.Hour, 5 * time.Minute, 0} {
+		if ttl := added[i].RR().TTL; ttl != want {
+			t.Errorf("expected %s to have TTL %s, got %s", added[i].RR().Name, want, ttl)
+		}
+	}
+
+	// the TTL of a proxied record is always automatic, so it's not a change
+	batchPath := "POST /zones/" + srv.Records(testZone)[0].ZoneID + "/dns_records/batch"
+	batches := countRequests(srv, batchPath)
+	if _, err := p.SetRecords(ctx, testZone, []libdns.Record{proxied}); err != nil {
+		t.Fatalf("setting records: %v", err)
+	}
+	if countRequests(srv, batchPath) != batches {
+		t.Errorf("expected setting the proxied record again to change nothing")
+	}
+
+	// but a TTL of 0 on an unproxied record means automatic
+	set, err := p.SetRecords(ctx, testZone, []libdns.Record{
+		libdns.Address{Name: "short", IP: netip.MustParseAddr("192.0.2.1")},
+	})
+	if err != nil {
+		t.Fatalf("setting records: %v", err)
+	}
+	if set[0].RR().TTL != 0 {
+		t.Errorf("expected TTL to become automatic, got %s", set[0].RR().TTL)
+	}
+	for _, rec := range srv.Records(testZone) {
+		if rec.Name == "short.example.com" && rec.TTL != 1 {
+			t.Errorf("expected Cloudflare TTL 1, got %d", rec.TTL)
+		}
+	}
+}
+
+func TestProtectedRecords(t *testing.T) {
+	p, srv := newTestProvider(t)
+	ctx := context.Background()
+
+	prio := uint16(10)
+	for _, rec := range []cloudflaretest.Record{
+		{Type: "MX", Name: "@", TTL: 1, Content: "route1.mx.cloudflare.net", Priority: &prio, Meta: map[string]any{"email_routing": true, "read_only": true}},
+		{Type: "A", Name: "locked", TTL: 1, Content: "192.0.2.1", Locked: true},
+	} {
+		if _, err := srv.AddRecord(testZone, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mx := libdns.MX{Name: "@", TTL: time.Hour, Preference: 20, Target: "mail.example.net."}
+
+	// by default, nothing is changed
+	_, err := p.SetRecords(ctx, testZone, []libdns.Record{mx})
+	var protectedErr *cloudflare.ProtectedRecordError
+	if !errors.As(err, &protectedErr) || !errors.Is(err, cloudflare.ErrProtectedRecord) {
+		t.Fatalf("expected a *ProtectedRecordError, got %v", err)
+	}
+	if len(protectedErr.Records) != 1 || protectedErr.Records[0].Reason != "read-only" {
+		t.Errorf("expected the MX record to be reported as read-only, got %+v", protectedErr.Records)
+	}
+	if _, err := p.DeleteRecords(ctx, testZone, []libdns.Record{libdns.RR{Name: "locked"}}); !errors.Is(err, cloudflare.ErrProtectedRecord) {
+		t.Errorf("expected deleting a locked record to be refused, got %v", err)
+	}
+	// even if it is given by ID, and not said to be protected
+	var lockedID string
+	for _, rec := range srv.Records(testZone) {
+		if rec.Locked {
+			lockedID = rec.ID
+		}
+	}
+	byID := libdns.Address{Name: "locked", IP: netip.MustParseAddr("192.0.2.1"), ProviderData: cloudflare.ProviderData{ID: lockedID}}
+	if _, err := p.DeleteRecords(ctx, testZone, []libdns.Record{byID}); !errors.Is(err, cloudflare.ErrProtectedRecord) {
+		t.Errorf("expected deleting a locked record by ID to be refused, got %v", err)
+	}
+	if n := len(srv.Records(testZone)); n != 2 {
+		t.Errorf("expected no changes, got %d records", n)
+	}
+
+	// records returned by GetRecords say why they're protected
+	recs, err := p.GetRecords(ctx, testZone)
+	if err != nil {
+		t.Fatalf("getting records: %v", err)
+	}
+	for _, rec := range recs {
+		if addr, ok := rec.(libdns.Address); ok && addr.ProviderData.(cloudflare.ProviderData).Protected != "locked" {
+			t.Errorf("expected the A record to be locked, got %#v", rec)
+		}
+	}
+
+	// they can be skipped instead
+	p.ProtectedRecords = "skip"
+	set, err := p.SetRecords(ctx, testZone, []libdns.Record{mx})
+	if err != nil {
+		t.Fatalf("setting records: %v", err)
+	}
+	if len(set) != 1 || set[0].RR().Data != "20 mail.example.net." {
+		t.Errorf("expected the new MX record to be created, got %v", set)
+	}
+	deleted, err := p.DeleteRecords(ctx, testZone, recs)
+	if err != nil {
+		t.Fatalf("deleting records: %v", err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("expected protected records to be skipped, got %v", deleted)
+	}
+	if n := len(srv.Records(testZone)); n != 3 {
+		t.Errorf("expected 3 records, got %d", n)
+	}
+	// skipped records are not returned as if they had been set
+	routeMX := libdns.MX{Name: "@", TTL: time.Hour, Preference: 10, Target: "route1.mx.cloudflare.net."}
+	set, err = p.SetRecords(ctx, testZone, []libdns.Record{mx, routeMX})
+	if err != nil {
+		t.Fatalf("setting records: %v", err)
+	}
+	if len(set) != 1 || set[0].RR().Data != "20 mail.example.net." {
+		t.Errorf("expected only the unprotected MX record to be returned, got %v", set)
+	}
+
+	// or changed anyway, which Cloudflare refuses
+	p.ProtectedRecords = "allow"
+	if _, err := p.DeleteRecords(ctx, testZone, []libdns.Record{libdns.RR{Name: "locked"}}); err == nil || errors.Is(err, cloudflare.ErrProtectedRecord) {
+		t.Errorf("expected Cloudflare to refuse deleting the locked record, got %v", err)
+	}
+}
+
+func TestExportZone(t *testing.T) {
+	p, _ := newTestProvider(t)
+	ctx := context.Background()
+
+	_, err := p.AppendRecords(ctx, testZone, []libdns.Record{
+		libdns.Address{Name: "@", TTL: time.Hour, IP: netip.MustParseAddr("192.0.2.1")},
+		libdns.Address{Name: "www", IP: netip.MustParseAddr("2001:db8::1"), ProviderData: cloudflare.ProviderData{Proxied: true}},
+		libdns.CNAME{Name: "blog", TTL: time.Hour, Target: "www.example.com."},
+		libdns.MX{Name: "@", TTL: time.Hour, Preference: 10, Target: "mail.example.net."},
+		libdns.TXT{Name: "@", TTL: time.Hour, Text: `v=spf1 include:"_spf.example.net" ~all; comment`},
+		libdns.TXT{Name: "long", TTL: time.Hour, Text: strings.Repeat("0123456789", 30)},
+		libdns.SRV{Service: "sip", Transport: "tcp", Name: "@", TTL: time.Hour, Priority: 10, Weight: 5, Port: 5060, Target: "sip.example.com."},
+		libdns.CAA{Name: "@", TTL: time.Hour, Tag: "issue", Value: "letsencrypt.org"},
+	})
+	if err != nil {
+		t.Fatalf("appending records: %v", err)
+	}
+
+	zoneFile, err := p.ExportZone(ctx, testZone)
+	if err != nil {
+		t.Fatalf("exporting zone: %v", err)
+	}
+	parsed, err := cloudflare.ParseZoneFile(testZone, bytes.NewReader(zoneFile))
+	if err != nil {
+		t.Fatalf("parsing zone file: %v\n%s", err, zoneFile)
+	}
+
+	recs, err := p.GetRecords(ctx, testZone)
+	if err != nil {
+		t.Fatalf("getting records: %v", err)
+	}
+	var want, got []string
+	for _, rec := range recs {
+		want = append(want, fmt.Sprintf("%+v", rec.RR()))
+	}
+	for _, rec := range parsed {
+		got = append(got, fmt.Sprintf("%+v", rec.RR()))
+	}
+	sort.Strings(want)
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the zone file to have the same records as the zone\ngot:  %q\nwant: %q\nzone file:\n%s", got, want, zoneFile)
+	}
+}
+
+func TestParseZoneFile(t *testing.T) {
+	zoneFile := `$ORIGIN example.com.
+$TTL 1h
+@	IN	SOA	ns1.example.com. hostmaster.example.com. (
+		2024010101 ; serial
+		7200 3600 1209600 3600 )
+	IN	NS	ns1.example.com.
+www	300	IN	A	192.0.2.1 ; cf_tags=cf-proxied:false
+	IN	300	AAAA	2001:db8::1
+txt		TXT	"first string" "second \"string\"" ; comment ; more
+$ORIGIN sub.example.com.
+deep	1	CNAME	www.example.com.
+blog	300	CNAME	www
+	300	MX	10 mail
+_sip._tcp	300	SRV	10 5 5060 @
+`
+	recs, err := cloudflare.ParseZoneFile("example.com", strings.NewReader(zoneFile))
+	if err != nil {
+		t.Fatalf("parsing zone file: %v", err)
+	}
+	want := []libdns.RR{
+		{Name: "@", TTL: time.Hour, Type: "NS", Data: "ns1.example.com."},
+		{Name: "www", TTL: 5 * time.Minute, Type: "A", Data: "192.0.2.1"},
+		{Name: "www", TTL: 5 * time.Minute, Type: "AAAA", Data: "2001:db8::1"},
+		{Name: "txt", TTL: time.Hour, Type: "TXT", Data: `first stringsecond "string"`},
+		{Name: "deep.sub", TTL: 0, Type: "CNAME", Data: "www.example.com."},
+		{Name: "blog.sub", TTL: 5 * time.Minute, Type: "CNAME", Data: "www.sub.example.com."},
+		{Name: "blog.sub", TTL: 5 * time.Minute, Type: "MX", Data: "10 mail.sub.example.com."},
+		{Name: "_sip._tcp.sub", TTL: 5 * time.Minute, Type: "SRV", Data: "10 5 5060 sub.example.com."},
+	}
+	if len(recs) != len(want) {
+		t.Fatalf("expected %d records, got %d: %v", len(want), len(recs), recs)
+	}
+	for i, rec := range recs {
+		if rr := rec.RR(); rr != want[i] {
+			t.Errorf("record %d: expected %+v, got %+v", i, want[i], rr)
+		}
+	}
+
+	if _, err := cloudflare.ParseZoneFile("example.com", strings.NewReader("www IN A (192.0.2.1\n")); err == nil {
+		t.Error("expected an error for unbalanced parentheses")
+	}
+}
+
+func TestListZonesPagination(t *testing.T) {
+	p, srv := newTestProvider(t)
+	p.ZoneToken = "zone-token" // not used to list zones
+	for i := 0; i < 60; i++ {
+		srv.AddZone(fmt.Sprintf("example%d.com", i))
+	}
+
+	zones, err := p.ListZones(context.Background())
+	if err != nil {
+		t.Fatalf("listing zones: %v", err)
+	}
+	if len(zones) != 61 {
+		t.Errorf("expected 61 zones, got %d", len(zones))
+	}
+
+	details, err := p.ListZoneDetails(context.Background(), cloudflare.ZoneFilter{Status: "pending"})
+	if err != nil {
+		t.Fatalf("listing zone details: %v", err)
+	}
+	if len(details) != 0 {
+		t.Errorf("expected no pending zones, got %+v", details)
+	}
+}
+
+func TestSplitName(t *testing.T) {
+	p, srv := newTestProvider(t)
+	srv.AddZone("eu.example.co.uk")
+	srv.AddZone("example.co.uk")
+
+	for fqdn, expected := range map[string][2]string{
+		"_acme-challenge.api.eu.example.co.uk.": {"eu.example.co.uk.", "_acme-challenge.api"},
+		"www.example.co.uk":                     {"example.co.uk.", "www"},
+		"Example.COM.":                          {"example.com.", "@"},
+	} {
+		zone, name, err := p.SplitName(context.Background(), fqdn)
+		if err != nil {
+			t.Errorf("splitting %s: %v", fqdn, err)
+			continue
+		}
+		if zone != expected[0] || name != expected[1] {
+			t.Errorf("splitting %s: expected %v, got %s %s", fqdn, expected, zone, name)
+		}
+	}
+
+	if _, err := p.FindZone(context.Background(), "www.example.org"); !errors.Is(err, cloudflare.ErrZoneNotFound) {
+		t.Errorf("expected ErrZoneNotFound, got %v", err)
+	}
+}
+
+func TestZoneCache(t *testing.T) {
+	p, srv := newTestProvider(t)
+	ctx := context.Background()
+
+	// concurrent lookups of the same zone share one request
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.GetRecords(ctx, testZone); err != nil {
+				t.Errorf("getting records: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := countRequests(srv, "GET /zones"); n != 1 {
+		t.Errorf("expected 1 zone lookup, got %d", n)
+	}
+
+	// a zone that was deleted and re-added gets a new ID; the stale one
+	// must be evicted from the cache when the API says it's gone
+	srv.RemoveZone(testZone)
+	srv.AddZone(testZone)
+	if _, err := p.GetRecords(ctx, testZone); !errors.Is(err, cloudflare.ErrZoneNotFound) {
+		t.Fatalf("expected ErrZoneNotFound with stale zone ID, got %v", err)
+	}
+	if _, err := p.GetRecords(ctx, testZone); err != nil {
+		t.Fatalf("expected stale zone to be evicted from cache, got %v", err)
+	}
+
+	p.ClearCache()
+	if _, err := p.GetRecords(ctx, testZone); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRequests(srv, "GET /zones"); n != 3 {
+		t.Errorf("expected 3 zone lookups in total, got %d", n)
+	}
+}
+
+// countRequests counts the requests made to srv that are exactly req.
+func countRequests(srv *cloudflaretest.Server, req string) int {
+	var n int
+	for _, r := range srv.Requests() {
+		if r == req {
+			n++
+		}
+	}
+	return n
+}
+
+func TestZoneNameForms(t *testing.T) {
+	p, srv := newTestProvider(t)
+	srv.AddZone("xn--bcher-kva.example")
+	ctx := context.Background()
+
+	for _, zone := range []string{"bücher.example.", "Bücher.Example", "xn--bcher-kva.example."} {
+		if _, err := p.SetRecords(ctx, zone, []libdns.Record{libdns.TXT{Name: "www", Text: zone}}); err != nil {
+			t.Fatalf("setting record in %s: %v", zone, err)
+		}
+		recs, err := p.GetRecords(ctx, zone)
+		if err != nil {
+			t.Fatalf("getting records in %s: %v", zone, err)
+		}
+		if len(recs) != 1 || recs[0].RR().Name != "www" {
+			t.Errorf("expected record name relative to %s, got %+v", zone, recs)
+		}
+	}
+	if n := countRequests(srv, "GET /zones"); n != 1 {
+		t.Errorf("expected all forms of the zone name to share a cache entry, got %d lookups", n)
+	}
+}
+
+func TestIterRecords(t *testing.T) {
+	p, srv := newTestProvider(t)
+	ctx := context.Background()
+
+	var recs []libdns.Record
+	for i := 0; i < 250; i++ {
+		recs = append(recs, libdns.TXT{Name: "iter", Text: fmt.Sprintf("value %d", i)})
+	}
+	recs = append(recs, libdns.Address{Name: "iter", IP: netip.MustParseAddr("192.0.2.1")})
+	if _, err := p.AppendRecords(ctx, testZone, recs); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	p.IterRecords(ctx, testZone, cloudflare.RecordFilter{Type: "TXT", Name: "iter"})(func(rec libdns.Record, err error) bool {
+		if err != nil {
+			t.Fatalf("iterating: %v", err)
+		}
+		if _, ok := rec.(libdns.TXT); !ok {
+			t.Errorf("expected only TXT records, got %#v", rec)
+		}
+		count++
+		return count < 150 // stop in the middle of the second page
+	})
+	if count != 150 {
+		t.Errorf("expected iteration to stop after 150 records, got %d", count)
+	}
+	if n := countRequests(srv, "GET /zones/"+srv.Records(testZone)[0].ZoneID+"/dns_records"); n != 2 {
+		t.Errorf("expected 2 pages to be fetched, got %d", n)
+	}
+}
+
+func TestGetRecordsConcurrentPages(t *testing.T) {
+	p, _ := newTestProvider(t)
+	p.PageConcurrency = 3
+	ctx := context.Background()
+
+	var recs []libdns.Record
+	for i := 0; i < 950; i++ {
+		recs = append(recs, libdns.TXT{Name: "page", Text: fmt.Sprintf("%04d", i)})
+	}
+	if _, err := p.AppendRecords(ctx, testZone, recs); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := p.GetRecords(ctx, testZone)
+	if err != nil {
+		t.Fatalf("getting records: %v", err)
+	}
+	if len(got) != len(recs) {
+		t.Fatalf("expected %d records, got %d", len(recs), len(got))
+	}
+	for i, rec := range got {
+		if text := rec.(libdns.TXT).Text; text != fmt.Sprintf("%04d", i) {
+			t.Fatalf("expected records in order; record %d is %q", i, text)
+		}
+	}
+}
+
+func TestQueryRecords(t *testing.T) {
+	p, _ := newTestProvider(t)
+	ctx := context.Background()
+
+	_, err := p.AppendRecords(ctx, testZone, []libdns.Record{
+		libdns.Address{Name: "api-eu", IP: netip.MustParseAddr("192.0.2.2")},
+		libdns.Address{Name: "api-us", IP: netip.MustParseAddr("192.0.2.1")},
+		libdns.Address{Name: "www", IP: netip.MustParseAddr("192.0.2.3")},
+		libdns.TXT{Name: "api-us", Text: "hello", ProviderData: cloudflare.ProviderData{Comment: "Greeting"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		filter   cloudflare.RecordFilter
+		expected []string
+	}{
+		{
+			filter:   cloudflare.RecordFilter{Type: "A", NameStartsWith: "api-", Order: "content"},
+			expected: []string{"api-us A 192.0.2.1", "api-eu A 192.0.2.2"},
+		},
+		{
+			filter:   cloudflare.RecordFilter{NameEndsWith: "-us.example.com", Direction: "desc", Order: "type"},
+			expected: []string{"api-us TXT hello", "api-us A 192.0.2.1"},
+		},
+		{
+			filter:   cloudflare.RecordFilter{CommentContains: "greet", ContentContains: "192.0.2.3", Match: "any"},
+			expected: []string{"www A 192.0.2.3", "api-us TXT hello"},
+		},
+	} {
+		recs, err := p.QueryRecords(ctx, testZone, test.filter)
+		if err != nil {
+			t.Fatalf("test %d: querying records: %v", i, err)
+		}
+		var got []string
+		for _, rec := range recs {
+			rr := rec.RR()
+			got = append(got, rr.Name+" "+rr.Type+" "+rr.Data)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.expected) {
+			t.Errorf("test %d: expected %v, got %v", i, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package cloudflare
+
+import "github.com/libdns/libdns"
+
+// ProviderData holds the Cloudflare-specific attributes of a DNS record.
+//
+// Records returned by this package have a ProviderData value in their
+// ProviderData field. To set these attributes when creating or updating
+// records, set the ProviderData field of the input records to a ProviderData
+// value (or pointer); all of its fields replace those of the record in
+// Cloudflare, so it is best to start from the value of a record returned by
+// GetRecords. Input records without ProviderData get Cloudflare's defaults when
+// created, and keep their current attributes when updated.
+type ProviderData struct {
+	// The IDs of the record and its zone in Cloudflare. They are set on
+	// records returned by this package, and are used to find records to
+	// update or delete without looking them up. (They are not attributes
+	// that can be changed.)
+	ID     string
+	ZoneID string
+
+	// Why Cloudflare doesn't allow changing the record, like "locked" or
+	// "read-only", or empty if it does (see Provider.ProtectedRecords).
+	// Set on records returned by this package; it can't be changed, and
+	// it is ignored in input records.
+	Protected string
+
+	// Whether traffic to the record is proxied through Cloudflare.
+	// Only A, AAAA, and CNAME records can be proxied.
+	Proxied bool
+
+	// A comment about the record, for humans.
+	Comment string
+
+	// Tags on the record, as "name:value" or just "name".
+	Tags []string
+
+	// Per-record settings.
+	Settings RecordSettings
+}
+
+// RecordSettings are Cloudflare's per-record settings. The IPv4Only and
+// IPv6Only settings only apply to A and AAAA records, and FlattenCNAME only
+// applies to CNAME records; they are ignored for other record types.
+type RecordSettings struct {
+	// For proxied records, only answer with IPv4 addresses.
+	IPv4Only bool
+
+	// For proxied records, only answer with IPv6 addresses.
+	IPv6Only bool
+
+	// Answer queries for the CNAME's name with the addresses of its target
+	// (CNAME flattening), instead of with the CNAME record.
+	FlattenCNAME bool
+}
+
+type cfRecordSettings struct {
+	IPv4Only     *bool `json:"ipv4_only,omitempty"`
+	IPv6Only     *bool `json:"ipv6_only,omitempty"`
+	FlattenCNAME *bool `json:"flatten_cname,omitempty"`
+}
+
+// providerData returns the Cloudflare-specific attributes of r.
+func (r cfDNSRecord) providerData() ProviderData {
+	data := ProviderData{ID: r.ID, ZoneID: r.ZoneID, Protected: r.protection()}
+	if r.Proxied != nil {
+		data.Proxied = *r.Proxied
+	}
+	if r.Comment != nil {
+		data.Comment = *r.Comment
+	}
+	if r.Tags != nil {
+		data.Tags = append([]string(nil), (*r.Tags)...)
+	}
+	if r.Settings != nil {
+		data.Settings.IPv4Only = derefBool(r.Settings.IPv4Only)
+		data.Settings.IPv6Only = derefBool(r.Settings.IPv6Only)
+		data.Settings.FlattenCNAME = derefBool(r.Settings.FlattenCNAME)
+	}
+	return data
+}
+
+// setProviderData sets the Cloudflare-specific attributes of r to those
+// in data, so that they are sent to the API even if they are zero values.
+func (r *cfDNSRecord) setProviderData(data ProviderData) {
+	proxied, comment := data.Proxied, data.Comment
+	tags := append([]string{}, data.Tags...)
+	r.Proxied = &proxied
+	r.Comment = &comment
+	r.Tags = &tags
+
+	settings := data.Settings
+	switch r.Type {
+	case "A", "AAAA":
+		r.Settings = &cfRecordSettings{IPv4Only: &settings.IPv4Only, IPv6Only: &settings.IPv6Only}
+	case "CNAME":
+		r.Settings = &cfRecordSettings{FlattenCNAME: &settings.FlattenCNAME}
+	}
+}
+
+// attributesDiffer returns true if any of the Cloudflare-specific attributes
+// set on r differ from those of existing.
+func (r cfDNSRecord) attributesDiffer(existing cfDNSRecord) bool {
+	if r.Proxied != nil && *r.Proxied != derefBool(existing.Proxied) {
+		return true
+	}
+	if r.Comment != nil && (existing.Comment == nil || *r.Comment != *existing.Comment) {
+		return true
+	}
+	if r.Tags != nil {
+		var existingTags []string
+		if existing.Tags != nil {
+			existingTags = *existing.Tags
+		}
+		if !sameStrings(*r.Tags, existingTags) {
+			return true
+		}
+	}
+	if r.Settings != nil {
+		want, have := *r.Settings, cfRecordSettings{}
+		if existing.Settings != nil {
+			have = *existing.Settings
+		}
+		if (want.IPv4Only != nil && *want.IPv4Only != derefBool(have.IPv4Only)) ||
+			(want.IPv6Only != nil && *want.IPv6Only != derefBool(have.IPv6Only)) ||
+			(want.FlattenCNAME != nil && *want.FlattenCNAME != derefBool(have.FlattenCNAME)) {
+			return true
+		}
+	}
+	return false
+}
+
+// providerDataOf returns the ProviderData of rec, if it has any.
+func providerDataOf(rec libdns.Record) (ProviderData, bool) {
+	var data any
+	switch r := rec.(type) {
+	case libdns.Address:
+		data = r.ProviderData
+	case libdns.CAA:
+		data = r.ProviderData
+	case libdns.CNAME:
+		data = r.ProviderData
+	case libdns.MX:
+		data = r.ProviderData
+	case libdns.NS:
+		data = r.ProviderData
+	case libdns.SRV:
+		data = r.ProviderData
+	case libdns.ServiceBinding:
+		data = r.ProviderData
+	case libdns.TXT:
+		data = r.ProviderData
+	}
+	switch d := data.(type) {
+	case ProviderData:
+		return d, true
+	case *ProviderData:
+		if d != nil {
+			return *d, true
+		}
+	}
+	return ProviderData{}, false
+}
+
+// withProviderData returns rec with its ProviderData field set to data,
+// if its type has such a field.
+func withProviderData(rec libdns.Record, data ProviderData) libdns.Record {
+	switch r := rec.(type) {
+	case libdns.Address:
+		r.ProviderData = data
+		return r
+	case libdns.CAA:
+		r.ProviderData = data
+		return r
+	case libdns.CNAME:
+		r.ProviderData = data
+		return r
+	case libdns.MX:
+		r.ProviderData = data
+		return r
+	case libdns.NS:
+		r.ProviderData = data
+		return r
+	case libdns.SRV:
+		r.ProviderData = data
+		return r
+	case libdns.ServiceBinding:
+		r.ProviderData = data
+		return r
+	case libdns.TXT:
+		r.ProviderData = data
+		return r
+	}
+	return rec
+}
+
+func derefBool(b *bool) bool {
+	return b != nil && *b
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int, len(a))
+	for _, s := range a {
+		counts[s]++
+	}
+	for _, s := range b {
+		if counts[s] == 0 {
+			return false
+		}
+		counts[s]--
+	}
+	return true
+}
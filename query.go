@@ -0,0 +1,167 @@
+package cloudflare
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/libdns/libdns"
+)
+
+// RecordFilter selects DNS records by their attributes, and orders them.
+// The filters are applied by Cloudflare, so only matching records are
+// downloaded. Empty fields are ignored. Name and comment filters are
+// case-insensitive, except for exact comment matches.
+type RecordFilter struct {
+	// The record type, like "A" or "TXT".
+	Type string
+
+	// The record name, relative to the zone (or a FQDN with a trailing dot).
+	Name string
+
+	// Parts of the record's fully-qualified name (without trailing dot).
+	NameContains   string
+	NameStartsWith string
+	NameEndsWith   string
+
+	// The record content, exactly as Cloudflare stores it. (Note that
+	// Cloudflare stores the content of TXT records in quotes.)
+	Content string
+
+	// Parts of the record's content.
+	ContentContains   string
+	ContentStartsWith string
+	ContentEndsWith   string
+
+	// Whether the record is proxied.
+	Proxied *bool
+
+	// A tag on the record: "name" to match any tag with that name, or
+	// "name:value" to match the tag exactly.
+	Tag string
+
+	// The record's comment, exactly.
+	Comment string
+
+	// Part of the record's comment.
+	CommentContains string
+
+	// Whether a record must match "all" of the filters (the default) or
+	// "any" of them.
+	Match string
+
+	// The field to order records by: "type", "name", "content", "ttl",
+	// or "proxied"; and the direction, "asc" (default) or "desc".
+	Order     string
+	Direction string
+}
+
+// query returns the query string parameters for the filter, for records
+// in the given zone (as returned by the API).
+func (f RecordFilter) query(zoneName string) url.Values {
+	qs := make(url.Values)
+	set := func(key, val string) {
+		if val != "" {
+			qs.Set(key, val)
+		}
+	}
+	set("type", f.Type)
+	if f.Name != "" {
+		qs.Set("name", normalizeDomain(libdns.AbsoluteName(f.Name, zoneName)))
+	}
+	set("name.contains", strings.ToLower(f.NameContains))
+	set("name.startswith", strings.ToLower(f.NameStartsWith))
+	set("name.endswith", strings.ToLower(f.NameEndsWith))
+	set("content.exact", f.Content)
+	set("content.contains", f.ContentContains)
+	set("content.startswith", f.ContentStartsWith)
+	set("content.endswith", f.ContentEndsWith)
+	if f.Proxied != nil {
+		qs.Set("proxied", strconv.FormatBool(*f.Proxied))
+	}
+	set("tag", f.Tag)
+	set("comment.exact", f.Comment)
+	set("comment.contains", f.CommentContains)
+	set("match", f.Match)
+	set("order", f.Order)
+	set("direction", f.Direction)
+	return qs
+}
+
+// QueryRecords returns the records in the zone that match the filter. It is
+// like GetRecords, but only downloads the matching records.
+func (p *Provider) QueryRecords(ctx context.Context, zone string, filter RecordFilter) ([]libdns.Record, error) {
+	zoneInfo, err := p.getZoneInfo(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	const maxPageSize = 100
+	cfRecs, err := getAllPages[cfDNSRecord](ctx, p, "/zones/"+zoneInfo.ID+"/dns_records", filter.query(zoneInfo.Name), maxPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	recs := make([]libdns.Record, 0, len(cfRecs))
+	for _, cfRec := range cfRecs {
+		rec, err := cfRec.libdnsRecord(zone)
+		if err != nil {
+			return nil, fmt.Errorf("parsing Cloudflare DNS record %+v: %v", cfRec, err)
+		}
+		recs = append(recs, rec)
+	}
+
+	return recs, nil
+}
+
+// IterRecords returns an iterator over the records in the zone that match
+// the filter. Records are fetched from the API one page at a time as the
+// iteration proceeds, and no more pages are fetched once the iteration
+// stops, so this is suitable for very large zones.
+//
+// The iterator yields each record with a nil error. If an error occurs, it
+// is yielded with a nil record, and the iteration ends. The iterator has the
+// same signature as iter.Seq2[libdns.Record, error], so with Go 1.23 or newer
+// it can be used with a for-range loop:
+//
+//	for rec, err := range provider.IterRecords(ctx, zone, filter) {
+//		if err != nil {
+//			return err
+//		}
+//		// use rec
+//	}
+func (p *Provider) IterRecords(ctx context.Context, zone string, filter RecordFilter) func(yield func(libdns.Record, error) bool) {
+	return func(yield func(libdns.Record, error) bool) {
+		zoneInfo, err := p.getZoneInfo(ctx, zone)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		const pageSize = 100
+		path := "/zones/" + zoneInfo.ID + "/dns_records"
+		query := filter.query(zoneInfo.Name)
+		for page := 1; ; page++ {
+			cfRecs, lastPage, err := getPage[cfDNSRecord](ctx, p, path, query, page, pageSize)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			for _, cfRec := range cfRecs {
+				rec, err := cfRec.libdnsRecord(zone)
+				if err != nil {
+					yield(nil, fmt.Errorf("parsing Cloudflare DNS record %+v: %v", cfRec, err))
+					return
+				}
+				if !yield(rec, nil) {
+					return
+				}
+			}
+			if page >= lastPage {
+				return
+			}
+		}
+	}
+}
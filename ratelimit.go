@@ -0,0 +1,128 @@
+package cloudflare
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token-bucket rate limiter that the provider waits on
+// before every API request. A single RateLimiter may be shared by many
+// Provider values (and goroutines) so that, together, they stay within
+// Cloudflare's per-token request budget.
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration // time to earn one token
+	burst    float64
+	tokens   float64
+	last     time.Time
+}
+
+// NewRateLimiter returns a rate limiter that allows n requests per
+// interval, with bursts of up to n requests.
+func NewRateLimiter(n int, per time.Duration) *RateLimiter {
+	if n <= 0 {
+		n = 1
+	}
+	return &RateLimiter{
+		interval: per / time.Duration(n),
+		burst:    float64(n),
+		tokens:   float64(n),
+		last:     time.Now(),
+	}
+}
+
+// Wait blocks until a request may be made. If the wait would outlast
+// ctx's deadline, or ctx is cancelled while waiting, it returns an error
+// without consuming a token; in the first case, the error wraps
+// [context.DeadlineExceeded].
+func (rl *RateLimiter) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	wait := rl.reserve()
+	if wait <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+		rl.cancel()
+		return fmt.Errorf("rate limit: would need to wait %s: %w", wait, context.DeadlineExceeded)
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		rl.cancel()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// reserve takes a token and returns how long the caller must wait
+// before using it. The token count may go negative, which queues
+// callers in the order they arrived.
+func (rl *RateLimiter) reserve() time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if rl.interval > 0 {
+		rl.tokens += float64(now.Sub(rl.last)) / float64(rl.interval)
+		if rl.tokens > rl.burst {
+			rl.tokens = rl.burst
+		}
+	}
+	rl.last = now
+
+	rl.tokens--
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens * float64(rl.interval))
+}
+
+// cancel gives back a token taken by reserve that will not be used.
+func (rl *RateLimiter) cancel() {
+	rl.mu.Lock()
+	rl.tokens++
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.mu.Unlock()
+}
+
+// SharedRateLimiter returns the process-wide rate limiter for the given API
+// token, creating it if necessary. Cloudflare enforces its request budget
+// (1200 requests per 5 minutes) per token, so all providers using the same
+// token should use the same limiter.
+func SharedRateLimiter(token string) *RateLimiter {
+	sharedLimitersMu.Lock()
+	defer sharedLimitersMu.Unlock()
+	if rl, ok := sharedLimiters[token]; ok {
+		return rl
+	}
+	rl := NewRateLimiter(1200, 5*time.Minute)
+	sharedLimiters[token] = rl
+	return rl
+}
+
+var (
+	sharedLimiters   = make(map[string]*RateLimiter)
+	sharedLimitersMu sync.Mutex
+)
+
+// rateLimiter returns the limiter to wait on before sending a request
+// authorized with the given token, or nil if requests are not limited.
+func (p *Provider) rateLimiter(token string) *RateLimiter {
+	if p.RateLimiter != nil {
+		return p.RateLimiter
+	}
+	if p.SharedRateLimit {
+		return SharedRateLimiter(token)
+	}
+	return nil
+}
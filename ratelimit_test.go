@@ -0,0 +1,127 @@
+package cloudflare_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/libdns/cloudflare"
+	"github.com/libdns/cloudflare/cloudflaretest"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := cloudflare.NewRateLimiter(5, 500*time.Millisecond) // one token per 100ms
+	ctx := context.Background()
+
+	// a full bucket allows a burst without waiting
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := rl.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected burst of 5 without waiting, took %s", elapsed)
+	}
+
+	// a wait that would outlast the deadline fails right away, without
+	// taking a token
+	deadlineCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	err := rl.Wait(deadlineCtx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 15*time.Millisecond {
+		t.Errorf("expected to fail without waiting, took %s", elapsed)
+	}
+
+	// the next token is earned after one interval
+	start = time.Now()
+	if err := rl.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 170*time.Millisecond {
+		t.Errorf("expected to wait about 100ms for the next token, took %s", elapsed)
+	}
+
+	// a cancelled context fails without waiting
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := rl.Wait(cancelledCtx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestSharedRateLimiter(t *testing.T) {
+	a := cloudflare.SharedRateLimiter("shared-token-a")
+	if cloudflare.SharedRateLimiter("shared-token-a") != a {
+		t.Error("expected the same limiter for the same token")
+	}
+	if cloudflare.SharedRateLimiter("shared-token-b") == a {
+		t.Error("expected different limiters for different tokens")
+	}
+}
+
+func TestProviderRateLimit(t *testing.T) {
+	t.Run("RateLimiter", func(t *testing.T) {
+		p, srv := newTestProvider(t)
+		cacheZone(t, p)
+		p.RateLimiter = cloudflare.NewRateLimiter(1, time.Hour)
+		drain(p.RateLimiter)
+		checkRateLimited(t, p, srv)
+	})
+
+	t.Run("SharedRateLimit", func(t *testing.T) {
+		p, srv := newTestProvider(t)
+		// a token of its own, so that no other test (or run of this
+		// test) shares the limiter
+		srv.Token = fmt.Sprintf("shared-rate-limit-token-%d", time.Now().UnixNano())
+		p.APIToken = srv.Token
+		cacheZone(t, p)
+		p.SharedRateLimit = true
+		drain(cloudflare.SharedRateLimiter(srv.Token))
+		checkRateLimited(t, p, srv)
+	})
+}
+
+// cacheZone looks up the test zone, so that later calls don't have to.
+func cacheZone(t *testing.T, p *cloudflare.Provider) {
+	t.Helper()
+	if _, err := p.GetRecords(context.Background(), testZone); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// drain takes all the tokens that rl has right now.
+func drain(rl *cloudflare.RateLimiter) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	for rl.Wait(ctx) == nil {
+	}
+}
+
+// checkRateLimited checks that p, whose rate limiter has no tokens left,
+// fails a request without sending it when the wait for the next token
+// would pass the context deadline.
+func checkRateLimited(t *testing.T, p *cloudflare.Provider, srv *cloudflaretest.Server) {
+	t.Helper()
+	sent := len(srv.Requests())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := p.GetRecords(ctx, testZone)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected to fail without waiting, took %s", elapsed)
+	}
+	if n := len(srv.Requests()) - sent; n != 0 {
+		t.Errorf("expected no requests to be sent, got %d", n)
+	}
+}
@@ -0,0 +1,384 @@
+package cloudflare
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/libdns/libdns"
+)
+
+// setStructuredData fills in r.Data from rr.Data, which is in presentation
+// format, for the record types whose data Cloudflare requires in structured
+// fields and which libdns doesn't have types for. Other types are left alone.
+func (r *cfDNSRecord) setStructuredData(rr libdns.RR) error {
+	switch rr.Type {
+	case "LOC", "SSHFP", "TLSA", "SMIMEA", "CERT", "DNSKEY", "DS", "NAPTR", "URI":
+	default:
+		return nil
+	}
+	if rr.Data == "" {
+		return nil
+	}
+	fields, err := rdataFields(rr.Data)
+	if err != nil {
+		return fmt.Errorf("invalid %s record data %q: %v", rr.Type, rr.Data, err)
+	}
+	invalid := fmt.Errorf("invalid %s record data %q", rr.Type, rr.Data)
+
+	// most of these types start with a few numbers, and end
+	// with a hex or base64 string that may contain spaces
+	nums, rest, err := leadingInts(fields, map[string]int{
+		"SSHFP":  2,
+		"TLSA":   3,
+		"SMIMEA": 3,
+		"CERT":   3,
+		"DNSKEY": 3,
+		"DS":     3,
+		"NAPTR":  2,
+		"URI":    2,
+	}[rr.Type])
+	if err != nil {
+		return invalid
+	}
+	blob := strings.Join(rest, "")
+
+	d := &r.Data
+	switch rr.Type {
+	case "LOC":
+		if err := d.setLOC(fields); err != nil {
+			return fmt.Errorf("%v: %v", invalid, err)
+		}
+	case "SSHFP":
+		if blob == "" {
+			return invalid
+		}
+		d.Algorithm, d.Type = &nums[0], &nums[1]
+		d.Fingerprint = blob
+	case "TLSA", "SMIMEA":
+		if blob == "" {
+			return invalid
+		}
+		d.Usage, d.Selector, d.MatchingType = &nums[0], &nums[1], &nums[2]
+		d.Certificate = blob
+	case "CERT":
+		if blob == "" {
+			return invalid
+		}
+		d.Type, d.KeyTag, d.Algorithm = &nums[0], &nums[1], &nums[2]
+		d.Certificate = blob
+	case "DNSKEY":
+		if blob == "" {
+			return invalid
+		}
+		d.Flags, d.Protocol, d.Algorithm = nums[0], &nums[1], &nums[2]
+		d.PublicKey = blob
+	case "DS":
+		if blob == "" {
+			return invalid
+		}
+		d.KeyTag, d.Algorithm, d.DigestType = &nums[0], &nums[1], &nums[2]
+		d.Digest = blob
+	case "NAPTR":
+		if len(rest) != 4 {
+			return invalid
+		}
+		d.Order, d.Preference = &nums[0], &nums[1]
+		d.Flags, d.Service, d.Regex, d.Replacement = rest[0], rest[1], rest[2], rest[3]
+	case "URI":
+		if len(rest) != 1 || nums[0] < 0 || nums[0] > 65535 || nums[1] < 0 || nums[1] > 65535 {
+			return invalid
+		}
+		r.Priority, d.Weight = uint16(nums[0]), uint16(nums[1])
+		d.Target = rest[0]
+	}
+
+	// the structured data is what counts; Cloudflare formats
+	// the content of these records in its own way
+	r.Content = ""
+	return nil
+}
+
+// setLOC fills in the LOC fields of d from the fields of LOC record
+// data (RFC 1876): latitude and longitude as degrees, optional minutes
+// and seconds, and a direction, then the altitude and the optional size
+// and horizontal and vertical precision, all in meters.
+func (d *cfRecordData) setLOC(fields []string) error {
+	coordinate := func(directions string) (deg, min int, sec float64, dir string, err error) {
+		var parts []string
+		for len(fields) > 0 && !strings.Contains(directions, strings.ToUpper(fields[0])) {
+			parts = append(parts, fields[0])
+			fields = fields[1:]
+		}
+		if len(fields) == 0 || len(parts) == 0 || len(parts) > 3 {
+			return 0, 0, 0, "", fmt.Errorf("expected coordinate ending in one of %s", directions)
+		}
+		dir = strings.ToUpper(fields[0])
+		fields = fields[1:]
+		if deg, err = strconv.Atoi(parts[0]); err != nil {
+			return
+		}
+		if len(parts) > 1 {
+			if min, err = strconv.Atoi(parts[1]); err != nil {
+				return
+			}
+		}
+		if len(parts) > 2 {
+			if sec, err = strconv.ParseFloat(parts[2], 64); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	latDeg, latMin, latSec, latDir, err := coordinate("NS")
+	if err != nil {
+		return err
+	}
+	longDeg, longMin, longSec, longDir, err := coordinate("EW")
+	if err != nil {
+		return err
+	}
+
+	// altitude, size, horizontal precision, vertical precision
+	meters := []float64{0, 1, 10000, 10}
+	if len(fields) == 0 || len(fields) > len(meters) {
+		return errors.New("expected altitude and at most 3 precision values")
+	}
+	for i, field := range fields {
+		m, err := strconv.ParseFloat(strings.TrimSuffix(field, "m"), 64)
+		if err != nil {
+			return err
+		}
+		meters[i] = m
+	}
+
+	d.LatDegrees, d.LatMinutes, d.LatSeconds, d.LatDirection = &latDeg, &latMin, &latSec, latDir
+	d.LongDegrees, d.LongMinutes, d.LongSeconds, d.LongDirection = &longDeg, &longMin, &longSec, longDir
+	d.Altitude, d.Size, d.PrecisionHorz, d.PrecisionVert = &meters[0], &meters[1], &meters[2], &meters[3]
+	return nil
+}
+
+// structuredData returns the data of r in presentation format, built
+// from its structured fields, for the types handled by setStructuredData.
+// It returns false if r has no structured data to build it from.
+func (r cfDNSRecord) structuredData() (string, bool) {
+	d := r.Data
+	switch r.Type {
+	case "LOC":
+		if d.LatDegrees == nil || d.LongDegrees == nil || d.LatDirection == "" || d.LongDirection == "" {
+			return "", false
+		}
+		return fmt.Sprintf("%d %d %s %s %d %d %s %s %sm %sm %sm %sm",
+			*d.LatDegrees, deref(d.LatMinutes), formatFloat(deref(d.LatSeconds)), d.LatDirection,
+			*d.LongDegrees, deref(d.LongMinutes), formatFloat(deref(d.LongSeconds)), d.LongDirection,
+			formatFloat(deref(d.Altitude)), formatFloat(deref(d.Size)),
+			formatFloat(deref(d.PrecisionHorz)), formatFloat(deref(d.PrecisionVert))), true
+	case "SSHFP":
+		if d.Algorithm == nil || d.Type == nil || d.Fingerprint == "" {
+			return "", false
+		}
+		return fmt.Sprintf("%d %d %s", *d.Algorithm, *d.Type, strings.ToLower(d.Fingerprint)), true
+	case "TLSA", "SMIMEA":
+		if d.Usage == nil || d.Selector == nil || d.MatchingType == nil || d.Certificate == "" {
+			return "", false
+		}
+		return fmt.Sprintf("%d %d %d %s", *d.Usage, *d.Selector, *d.MatchingType, strings.ToLower(d.Certificate)), true
+	case "CERT":
+		if d.Type == nil || d.KeyTag == nil || d.Algorithm == nil || d.Certificate == "" {
+			return "", false
+		}
+		return fmt.Sprintf("%d %d %d %s", *d.Type, *d.KeyTag, *d.Algorithm, d.Certificate), true
+	case "DNSKEY":
+		if d.Flags == nil || d.Protocol == nil || d.Algorithm == nil || d.PublicKey == "" {
+			return "", false
+		}
+		return fmt.Sprintf("%d %d %d %s", anyInt(d.Flags), *d.Protocol, *d.Algorithm, d.PublicKey), true
+	case "DS":
+		if d.KeyTag == nil || d.Algorithm == nil || d.DigestType == nil || d.Digest == "" {
+			return "", false
+		}
+		return fmt.Sprintf("%d %d %d %s", *d.KeyTag, *d.Algorithm, *d.DigestType, strings.ToLower(d.Digest)), true
+	case "NAPTR":
+		if d.Order == nil || d.Preference == nil {
+			return "", false
+		}
+		replacement := d.Replacement
+		if replacement == "" {
+			replacement = "."
+		}
+		flags, _ := d.Flags.(string)
+		return fmt.Sprintf("%d %d %s %s %s %s", *d.Order, *d.Preference,
+			quoteField(flags), quoteField(d.Service), quoteField(d.Regex), replacement), true
+	case "URI":
+		if d.Target == "" {
+			return "", false
+		}
+		return fmt.Sprintf("%d %d %s", r.Priority, d.Weight, quoteField(d.Target)), true
+	}
+	return "", false
+}
+
+// canonicalData returns the data of rr as it would be returned by
+// Cloudflare, for comparing the data of record types with structured
+// data. If the data can't be parsed, it is returned as-is.
+func canonicalData(rr libdns.RR) string {
+	r := cfDNSRecord{Type: rr.Type}
+	if err := r.setStructuredData(rr); err != nil {
+		return rr.Data
+	}
+	if data, ok := r.structuredData(); ok {
+		return data
+	}
+	return rr.Data
+}
+
+// rdataFields splits record data in presentation format into its fields.
+// Fields may be quoted to contain spaces, and backslash escapes (\X and
+// \DDD) are resolved; the returned fields are unquoted and unescaped.
+func rdataFields(data string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	inField, quoted := false, false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\\':
+			if i+1 == len(data) {
+				return nil, errors.New("trailing backslash")
+			}
+			if i+3 < len(data) && isDigits(data[i+1:i+4]) {
+				n, _ := strconv.Atoi(data[i+1 : i+4])
+				if n > 255 {
+					return nil, fmt.Errorf("invalid escape \\%s", data[i+1:i+4])
+				}
+				field.WriteByte(byte(n))
+				i += 3
+			} else {
+				field.WriteByte(data[i+1])
+				i++
+			}
+			inField = true
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteByte(c)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quoted string")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+// quoteField quotes s for use as a field in presentation format (RFC 1035
+// section 5.1): quotes and backslashes are escaped with a backslash, and
+// bytes that aren't printable ASCII with \DDD, so any bytes round-trip.
+func quoteField(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// needsEscaping returns true if quoteField would escape any of s.
+func needsEscaping(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '"' || c == '\\' || c < ' ' || c > '~' {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCAA parses CAA record data in presentation format, which libdns
+// can't do if the value contains spaces or escapes.
+func parseCAA(data string) (flags uint8, tag, value string, err error) {
+	fields, err := rdataFields(data)
+	if err != nil {
+		return 0, "", "", err
+	}
+	if len(fields) != 3 {
+		return 0, "", "", fmt.Errorf("expected 3 fields in CAA record data %q", data)
+	}
+	n, err := strconv.ParseUint(fields[0], 10, 8)
+	if err != nil {
+		return 0, "", "", fmt.Errorf("invalid CAA flags %q: %v", fields[0], err)
+	}
+	return uint8(n), fields[1], fields[2], nil
+}
+
+// leadingInts parses the first n fields as integers, and returns
+// them along with the rest of the fields.
+func leadingInts(fields []string, n int) ([]int, []string, error) {
+	if len(fields) < n {
+		return nil, nil, errors.New("too few fields")
+	}
+	nums := make([]int, n)
+	for i := range nums {
+		num, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		nums[i] = num
+	}
+	return nums, fields[n:], nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// anyInt returns the integer value of v, a number decoded from JSON.
+func anyInt(v any) int {
+	switch v := v.(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func deref[T any](p *T) T {
+	var v T
+	if p != nil {
+		v = *p
+	}
+	return v
+}
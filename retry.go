@@ -0,0 +1,188 @@
+package cloudflare
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy configures how API requests that fail with a transient
+// error are retried. Zero-valued fields take their default values.
+type RetryPolicy struct {
+	// The maximum number of attempts for a single request, including
+	// the first one. Set to 1 to disable retries. Default: 3.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+
+	// The delay before the first retry; it is doubled for each
+	// subsequent attempt and jittered. Default: 500ms.
+	BaseDelay time.Duration `json:"base_delay,omitempty"`
+
+	// The longest the provider will wait before any single retry. If
+	// Cloudflare asks us (via Retry-After) to wait longer than this, the
+	// error is returned instead. Default: 5s.
+	MaxDelay time.Duration `json:"max_delay,omitempty"`
+
+	// HTTP status codes that are considered transient.
+	// Default: 429, 500, 502, 503, 504.
+	RetryStatusCodes []int `json:"retry_status_codes,omitempty"`
+
+	// Cloudflare API error codes that are considered transient,
+	// regardless of the HTTP status. Default: 971.
+	RetryErrorCodes []int `json:"retry_error_codes,omitempty"`
+}
+
+// retryPolicy returns the retry policy to use, with defaults filled in.
+func (p *Provider) retryPolicy() RetryPolicy {
+	var policy RetryPolicy
+	if p.Retry != nil {
+		policy = *p.Retry
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 3
+	}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = 500 * time.Millisecond
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = 5 * time.Second
+	}
+	if policy.RetryStatusCodes == nil {
+		policy.RetryStatusCodes = []int{
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		}
+	}
+	if policy.RetryErrorCodes == nil {
+		policy.RetryErrorCodes = []int{971} // "Please wait and consider throttling your request speed"
+	}
+	return policy
+}
+
+// shouldRetry reports whether a request that failed with the given response
+// and response body may be tried again. resp is nil if the request never
+// got a response at all (e.g. a connection error).
+func (policy RetryPolicy) shouldRetry(req *http.Request, resp *http.Response, respData cfResponse) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false // can't replay the body
+	}
+
+	// a 429 means the request was not processed, so even requests
+	// that aren't idempotent are safe to send again
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		return containsInt(policy.RetryStatusCodes, resp.StatusCode)
+	}
+	if !idempotent(req.Method) {
+		return false
+	}
+	if resp == nil {
+		return true
+	}
+	if containsInt(policy.RetryStatusCodes, resp.StatusCode) {
+		return true
+	}
+	for _, e := range respData.Errors {
+		if containsInt(policy.RetryErrorCodes, e.Code) {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns how long to wait before making the given attempt (which
+// is at least 2). It honors the Retry-After header, if any. It returns
+// false if the request should not be retried because the server asks us
+// to wait longer than the policy allows.
+func (policy RetryPolicy) delay(attempt int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil {
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return wait, wait <= policy.MaxDelay
+		}
+	}
+
+	backoff := policy.BaseDelay << (attempt - 2)
+	if backoff > policy.MaxDelay || backoff <= 0 {
+		backoff = policy.MaxDelay
+	}
+	// "equal jitter": wait at least half the backoff so retries don't
+	// collapse to zero, but spread them out to avoid thundering herds
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1)), true
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which
+// may either be a number of seconds or an HTTP date.
+func parseRetryAfter(val string) (time.Duration, bool) {
+	if val == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(val); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if when, err := http.ParseTime(val); err == nil {
+		wait := time.Until(when)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// sleepContext waits for d to elapse, returning early with an error if
+// ctx is done first, or immediately if ctx's deadline is sooner than d.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return context.DeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// rewindRequest returns a copy of req that can be sent again.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	next := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		next.Body = body
+	}
+	return next, nil
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodPut, http.MethodPatch, http.MethodDelete:
+		// PATCH isn't idempotent in general, but it is for the way we use it
+		return true
+	}
+	return false
+}
+
+func containsInt(list []int, v int) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package cloudflare_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/libdns/cloudflare"
+	"github.com/libdns/cloudflare/cloudflaretest"
+	"github.com/libdns/libdns"
+)
+
+// newRetryTestProvider returns a provider with short retry delays and
+// the test zone already cached, so that the only requests made are the
+// ones being tested, and the request paths for listing and batching the
+// zone's records.
+func newRetryTestProvider(t *testing.T) (p *cloudflare.Provider, srv *cloudflaretest.Server, listReq, batchReq string) {
+	t.Helper()
+	p, srv = newTestProvider(t)
+	p.Retry = &cloudflare.RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	if _, err := p.AppendRecords(context.Background(), testZone, []libdns.Record{
+		libdns.Address{Name: "www", IP: netip.MustParseAddr("192.0.2.1")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	zoneID := srv.Records(testZone)[0].ZoneID
+	return p, srv, "GET /zones/" + zoneID + "/dns_records", "POST /zones/" + zoneID + "/dns_records/batch"
+}
+
+func TestRetryIdempotentRequest(t *testing.T) {
+	p, srv, listReq, _ := newRetryTestProvider(t)
+
+	srv.InjectFailures(2, http.StatusServiceUnavailable, "")
+	recs, err := p.GetRecords(context.Background(), testZone)
+	if err != nil {
+		t.Fatalf("expected GetRecords to succeed after retrying, got %v", err)
+	}
+	if len(recs) != 1 {
+		t.Errorf("expected 1 record, got %v", recs)
+	}
+	if n := countRequests(srv, listReq); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+}
+
+func TestRetryRateLimitedPost(t *testing.T) {
+	p, srv, _, batchReq := newRetryTestProvider(t)
+	before := countRequests(srv, batchReq)
+
+	srv.InjectFailures(1, http.StatusTooManyRequests, "")
+	_, err := p.AppendRecords(context.Background(), testZone, []libdns.Record{
+		libdns.TXT{Name: "retried", Text: "hello"},
+	})
+	if err != nil {
+		t.Fatalf("expected rate-limited POST to be retried, got %v", err)
+	}
+	if n := countRequests(srv, batchReq) - before; n != 2 {
+		t.Errorf("expected 2 attempts, got %d", n)
+	}
+}
+
+func TestNoRetryServerErrorPost(t *testing.T) {
+	p, srv, _, batchReq := newRetryTestProvider(t)
+	before := countRequests(srv, batchReq)
+
+	srv.InjectFailures(1, http.StatusBadGateway, "")
+	_, err := p.AppendRecords(context.Background(), testZone, []libdns.Record{
+		libdns.TXT{Name: "not-retried", Text: "hello"},
+	})
+	var apiErr *cloudflare.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected a 502 APIError, got %v", err)
+	}
+	if n := countRequests(srv, batchReq) - before; n != 1 {
+		t.Errorf("expected POST not to be retried after a 5xx, got %d attempts", n)
+	}
+}
+
+func TestRetryAfterTooLong(t *testing.T) {
+	p, srv, listReq, _ := newRetryTestProvider(t)
+
+	srv.InjectFailures(1, http.StatusTooManyRequests, "60")
+	start := time.Now()
+	_, err := p.GetRecords(context.Background(), testZone)
+	if !errors.Is(err, cloudflare.ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to give up without waiting, took %s", elapsed)
+	}
+	if n := countRequests(srv, listReq); n != 1 {
+		t.Errorf("expected 1 attempt, got %d", n)
+	}
+}
+
+func TestRetryContextDeadline(t *testing.T) {
+	p, srv, listReq, _ := newRetryTestProvider(t)
+	p.Retry = &cloudflare.RetryPolicy{BaseDelay: 10 * time.Second, MaxDelay: 20 * time.Second}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	srv.InjectFailures(1, http.StatusServiceUnavailable, "")
+	start := time.Now()
+	_, err := p.GetRecords(ctx, testZone)
+	var apiErr *cloudflare.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the 503 APIError, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to give up before the deadline, took %s", elapsed)
+	}
+	if n := countRequests(srv, listReq); n != 1 {
+		t.Errorf("expected 1 attempt, got %d", n)
+	}
+}
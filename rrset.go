@@ -0,0 +1,122 @@
+package cloudflare
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/libdns/libdns"
+)
+
+// rrset is a group of input records with the same name and type.
+type rrset struct {
+	records []libdns.Record
+	indexes []int // position of each record in the input
+}
+
+// groupRRsets groups records by (name, type), in order of first appearance.
+func groupRRsets(zone string, records []libdns.Record) []*rrset {
+	var sets []*rrset
+	byKey := make(map[string]*rrset)
+	for i, rec := range records {
+		rr := rec.RR()
+		key := normalizeDomain(libdns.AbsoluteName(rr.Name, zone)) + " " + rr.Type
+		set, ok := byKey[key]
+		if !ok {
+			set = new(rrset)
+			byKey[key] = set
+			sets = append(sets, set)
+		}
+		set.records = append(set.records, rec)
+		set.indexes = append(set.indexes, i)
+	}
+	return sets
+}
+
+// matchRRset pairs each of the input records of an RRset with the existing
+// record (the index into existing) that it should replace, or -1 if there is
+// none and it should be created. Input records are paired with the existing
+// record with the same Cloudflare ID if they have one (see ProviderData),
+// then with existing records with the same data, then with any remaining
+// existing records that aren't protected (see cfDNSRecord.protection).
+// Existing records that aren't paired should be deleted.
+func matchRRset(zone string, inputs []libdns.Record, existing []cfDNSRecord) []int {
+	matches := make([]int, len(inputs))
+	claimed := make([]bool, len(existing))
+	claim := func(i int, match func(j int) bool) {
+		for j := range existing {
+			if !claimed[j] && match(j) {
+				claimed[j] = true
+				matches[i] = j
+				return
+			}
+		}
+	}
+
+	existingRRs := make([]libdns.RR, len(existing))
+	for j, ex := range existing {
+		if rec, err := ex.libdnsRecord(zone); err == nil {
+			existingRRs[j] = rec.RR()
+		}
+	}
+
+	for i, rec := range inputs {
+		matches[i] = -1
+		if data, ok := providerDataOf(rec); ok && data.ID != "" {
+			claim(i, func(j int) bool { return existing[j].ID == data.ID })
+		}
+	}
+	for i, rec := range inputs {
+		if matches[i] < 0 {
+			claim(i, func(j int) bool { return sameData(existingRRs[j], rec.RR()) })
+		}
+	}
+	for i := range inputs {
+		if matches[i] < 0 {
+			claim(i, func(j int) bool { return existing[j].protection() == "" })
+		}
+	}
+
+	return matches
+}
+
+// sameData returns true if a and b have equivalent data, ignoring
+// differences that don't matter, like a trailing dot on a target.
+func sameData(a, b libdns.RR) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	switch a.Type {
+	case "CNAME", "MX", "NS", "SRV", "HTTPS", "SVCB":
+		fa, fb := strings.Fields(a.Data), strings.Fields(b.Data)
+		if len(fa) != len(fb) {
+			return false
+		}
+		for i := range fa {
+			if !strings.EqualFold(strings.TrimSuffix(fa[i], "."), strings.TrimSuffix(fb[i], ".")) {
+				return false
+			}
+		}
+		return true
+	case "A", "AAAA":
+		return a.Data == b.Data || normalizeIP(a.Data) == normalizeIP(b.Data)
+	case "CAA":
+		if a.Data == b.Data {
+			return true
+		}
+		flagsA, tagA, valueA, errA := parseCAA(a.Data)
+		flagsB, tagB, valueB, errB := parseCAA(b.Data)
+		return errA == nil && errB == nil &&
+			flagsA == flagsB && strings.EqualFold(tagA, tagB) && valueA == valueB
+	case "LOC", "SSHFP", "TLSA", "SMIMEA", "CERT", "DNSKEY", "DS", "NAPTR", "URI":
+		return a.Data == b.Data || canonicalData(a) == canonicalData(b)
+	}
+	return a.Data == b.Data
+}
+
+func normalizeIP(s string) string {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return s
+	}
+	return addr.String()
+}
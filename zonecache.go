@@ -0,0 +1,178 @@
+package cloudflare
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// zoneCache caches zone info by zone name. Concurrent lookups of the same
+// zone share a single API request, and lookups of different zones don't
+// block each other.
+type zoneCache struct {
+	mu       sync.Mutex
+	zones    map[string]zoneCacheEntry
+	names    map[string]string // FQDN -> name of enclosing zone (see FindZone)
+	inflight map[string]*zoneLookup
+
+	// incremented by every invalidation, so that lookups that were in
+	// flight at the time don't cache their (possibly stale) results
+	generation uint64
+}
+
+type zoneCacheEntry struct {
+	zone    cfZone
+	expires time.Time
+}
+
+// zoneLookup is an in-flight request for a zone's info.
+type zoneLookup struct {
+	done       chan struct{} // closed when zone and err are set
+	zone       cfZone
+	err        error
+	generation uint64 // of the cache when the lookup started
+}
+
+// get returns the info for the named zone, from the cache if available and
+// not expired; otherwise it calls fetch, or waits for the result of another
+// goroutine's call to fetch for the same zone (unless the cache was
+// invalidated since that call started). Successful results are cached
+// for ttl, or not at all if ttl is negative or the cache was invalidated
+// during the call.
+func (c *zoneCache) get(ctx context.Context, name string, ttl time.Duration, fetch func(context.Context) (cfZone, error)) (cfZone, error) {
+	for {
+		c.mu.Lock()
+		if entry, ok := c.zones[name]; ok && time.Now().Before(entry.expires) {
+			c.mu.Unlock()
+			return entry.zone, nil
+		}
+		if lookup, ok := c.inflight[name]; ok && lookup.generation == c.generation {
+			c.mu.Unlock()
+			select {
+			case <-lookup.done:
+			case <-ctx.Done():
+				return cfZone{}, ctx.Err()
+			}
+			if isContextErr(lookup.err) && ctx.Err() == nil {
+				continue // the other caller gave up, but we haven't
+			}
+			return lookup.zone, lookup.err
+		}
+		lookup := &zoneLookup{done: make(chan struct{}), generation: c.generation}
+		if c.inflight == nil {
+			c.inflight = make(map[string]*zoneLookup)
+		}
+		c.inflight[name] = lookup
+		c.mu.Unlock()
+
+		lookup.zone, lookup.err = fetch(ctx)
+
+		c.mu.Lock()
+		if c.inflight[name] == lookup {
+			delete(c.inflight, name)
+		}
+		if lookup.err == nil && ttl >= 0 && lookup.generation == c.generation {
+			if c.zones == nil {
+				c.zones = make(map[string]zoneCacheEntry)
+			}
+			c.zones[name] = zoneCacheEntry{zone: lookup.zone, expires: time.Now().Add(ttl)}
+		}
+		c.mu.Unlock()
+		close(lookup.done)
+
+		return lookup.zone, lookup.err
+	}
+}
+
+// enclosingZone returns the cached name of the zone that contains fqdn,
+// if it is known and the zone's info has not expired.
+func (c *zoneCache) enclosingZone(fqdn string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	zone, ok := c.names[fqdn]
+	if !ok {
+		return "", false
+	}
+	if entry, ok := c.zones[zone]; !ok || !time.Now().Before(entry.expires) {
+		delete(c.names, fqdn)
+		return "", false
+	}
+	return zone, true
+}
+
+// setEnclosingZone remembers that fqdn is in the named zone.
+func (c *zoneCache) setEnclosingZone(fqdn, zone string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.names == nil {
+		c.names = make(map[string]string)
+	}
+	c.names[fqdn] = zone
+}
+
+// invalidate removes zones from the cache for which remove returns true,
+// along with any names known to be in those zones. Lookups in flight are
+// not cached when they finish, since they may be for one of those zones.
+func (c *zoneCache) invalidate(remove func(name string, zone cfZone) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for name, entry := range c.zones {
+		if remove(name, entry.zone) {
+			delete(c.zones, name)
+			for fqdn, zone := range c.names {
+				if zone == name {
+					delete(c.names, fqdn)
+				}
+			}
+		}
+	}
+}
+
+// InvalidateZone removes the named zone from the provider's cache, so
+// that its info is looked up again the next time it is needed.
+func (p *Provider) InvalidateZone(zone string) {
+	zone = normalizeDomain(zone)
+	p.zoneCache.invalidate(func(name string, _ cfZone) bool {
+		return name == zone
+	})
+}
+
+// ClearCache removes all zones from the provider's cache.
+func (p *Provider) ClearCache() {
+	p.zoneCache.invalidate(func(string, cfZone) bool { return true })
+}
+
+// zoneCacheTTL returns how long to cache zone info for.
+func (p *Provider) zoneCacheTTL() time.Duration {
+	if p.ZoneCacheTTL == 0 {
+		return time.Hour
+	}
+	return p.ZoneCacheTTL
+}
+
+// invalidateZoneOnError removes the zone targeted by req from the cache if
+// err indicates that the zone no longer exists (for example, because it
+// was deleted and re-added with a new ID).
+func (p *Provider) invalidateZoneOnError(req *http.Request, err error) {
+	if !errors.Is(err, ErrZoneNotFound) {
+		return
+	}
+	segments := strings.Split(req.URL.Path, "/")
+	for i := 0; i < len(segments)-1; i++ {
+		if segments[i] == "zones" && segments[i+1] != "" {
+			zoneID := segments[i+1]
+			p.zoneCache.invalidate(func(_ string, zone cfZone) bool {
+				return zone.ID == zoneID
+			})
+			return
+		}
+	}
+}
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
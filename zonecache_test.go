@@ -0,0 +1,70 @@
+package cloudflare
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestZoneCacheInvalidateInFlight(t *testing.T) {
+	var c zoneCache
+	ctx := context.Background()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	result := make(chan cfZone)
+	go func() {
+		zone, _ := c.get(ctx, "example.com", time.Hour, func(context.Context) (cfZone, error) {
+			close(started)
+			<-release
+			return cfZone{ID: "old"}, nil
+		})
+		result <- zone
+	}()
+	<-started
+
+	// the zone is invalidated while it is being looked up, so a new
+	// lookup doesn't wait for that one, and that one isn't cached
+	c.invalidate(func(string, cfZone) bool { return true })
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	zone, err := c.get(timeoutCtx, "example.com", time.Hour, func(context.Context) (cfZone, error) {
+		return cfZone{ID: "new"}, nil
+	})
+	if err != nil || zone.ID != "new" {
+		t.Fatalf("expected a new lookup after invalidating, got %q, %v", zone.ID, err)
+	}
+	close(release)
+	if zone := <-result; zone.ID != "old" {
+		t.Errorf("expected the first lookup to get its own result, got %q", zone.ID)
+	}
+
+	zone, err = c.get(ctx, "example.com", time.Hour, func(context.Context) (cfZone, error) {
+		return cfZone{ID: "unexpected"}, nil
+	})
+	if err != nil || zone.ID != "new" {
+		t.Errorf("expected the new lookup to be cached, got %q, %v", zone.ID, err)
+	}
+
+	// the same goes for a lookup that is in flight by itself
+	started, release = make(chan struct{}), make(chan struct{})
+	c.invalidate(func(string, cfZone) bool { return true })
+	go func() {
+		zone, _ := c.get(ctx, "example.com", time.Hour, func(context.Context) (cfZone, error) {
+			close(started)
+			<-release
+			return cfZone{ID: "stale"}, nil
+		})
+		result <- zone
+	}()
+	<-started
+	c.invalidate(func(string, cfZone) bool { return true })
+	close(release)
+	<-result
+
+	zone, err = c.get(ctx, "example.com", time.Hour, func(context.Context) (cfZone, error) {
+		return cfZone{ID: "fresh"}, nil
+	})
+	if err != nil || zone.ID != "fresh" {
+		t.Errorf("expected a lookup that was invalidated not to be cached, got %q, %v", zone.ID, err)
+	}
+}
@@ -0,0 +1,118 @@
+package cloudflare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// ZoneFilter filters the zones listed by ListZoneDetails. Empty fields
+// match all zones.
+type ZoneFilter struct {
+	// The ID of the account that owns the zones.
+	AccountID string
+
+	// The status of the zones: "initializing", "pending", "active",
+	// "moved", "deleted", or "deactivated".
+	Status string
+
+	// The type of the zones: "full", "partial", or "secondary".
+	Type string
+}
+
+// ZoneDetails describes a Cloudflare zone.
+type ZoneDetails struct {
+	// The zone's ID in Cloudflare.
+	ID string
+
+	// The zone's name, as a FQDN (with trailing dot).
+	Name string
+
+	// The zone's status (e.g. "active", "pending", "moved") and type
+	// (e.g. "full", "partial", "secondary").
+	Status string
+	Type   string
+
+	// Whether Cloudflare's proxying (security and performance features)
+	// is paused for the zone.
+	Paused bool
+
+	// The Cloudflare name servers assigned to the zone, and the
+	// name servers the zone used before moving to Cloudflare.
+	NameServers         []string
+	OriginalNameServers []string
+
+	// The name of the zone's plan, like "Free Website".
+	Plan string
+
+	// The account that owns the zone.
+	AccountID   string
+	AccountName string
+
+	CreatedOn   time.Time
+	ModifiedOn  time.Time
+	ActivatedOn time.Time
+}
+
+func (z cfZone) details() ZoneDetails {
+	return ZoneDetails{
+		ID:                  z.ID,
+		Name:                z.Name + ".", // make it a FQDN
+		Status:              z.Status,
+		Type:                z.Type,
+		Paused:              z.Paused,
+		NameServers:         z.NameServers,
+		OriginalNameServers: z.OriginalNameServers,
+		Plan:                z.Plan.Name,
+		AccountID:           z.Account.ID,
+		AccountName:         z.Account.Name,
+		CreatedOn:           z.CreatedOn,
+		ModifiedOn:          z.ModifiedOn,
+		ActivatedOn:         z.ActivatedOn,
+	}
+}
+
+// FindZone returns the name of the Cloudflare zone that contains the given
+// fully-qualified domain name, as a FQDN (with trailing dot). It looks up
+// each of the name's parent domains in turn, most specific first, so that
+// delegated subdomains are found if they are zones of their own. The zone
+// token is used for the lookups if it is set. Results are cached.
+func (p *Provider) FindZone(ctx context.Context, fqdn string) (string, error) {
+	fqdn = normalizeDomain(fqdn)
+
+	if zone, ok := p.zoneCache.enclosingZone(fqdn); ok {
+		return zone + ".", nil
+	}
+
+	labels := strings.Split(fqdn, ".")
+	for i := 0; i < len(labels)-1; i++ { // top-level domains aren't zones
+		candidate := strings.Join(labels[i:], ".")
+		zoneInfo, err := p.getZoneInfo(ctx, candidate)
+		if errors.Is(err, ErrZoneNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		p.zoneCache.setEnclosingZone(fqdn, candidate)
+		return zoneInfo.Name + ".", nil
+	}
+
+	return "", fmt.Errorf("%w: no zone contains %s", ErrZoneNotFound, fqdn)
+}
+
+// SplitName splits the given fully-qualified domain name into the name of
+// the Cloudflare zone that contains it (see FindZone) and the name relative
+// to that zone, ready to be used with the other Provider methods.
+func (p *Provider) SplitName(ctx context.Context, fqdn string) (zone, name string, err error) {
+	zone, err = p.FindZone(ctx, fqdn)
+	if err != nil {
+		return "", "", err
+	}
+	return zone, libdns.RelativeName(normalizeDomain(fqdn), zone), nil
+}